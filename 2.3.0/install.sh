@@ -36,7 +36,7 @@ TMP_DIR=$(mktemp -d); trap 'rm -rf -- "$TMP_DIR"' EXIT; cd "$TMP_DIR"
 SOURCE_FILE_URL="https://raw.githubusercontent.com/${GITHUB_REPO}/main/phantom.go"
 curl -sSL -o "${SOURCE_FILE_NAME}" "$SOURCE_FILE_URL"
 export GOPROXY=direct; go mod init phantom-tunnel &>/dev/null || true
-go get nhooyr.io/websocket &>/dev/null; go get github.com/hashicorp/yamux &>/dev/null; go mod tidy &>/dev/null
+go get nhooyr.io/websocket &>/dev/null; go get github.com/hashicorp/yamux &>/dev/null; go get github.com/quic-go/quic-go &>/dev/null; go get gopkg.in/yaml.v3 &>/dev/null; go get golang.org/x/crypto/bcrypt &>/dev/null; go get modernc.org/sqlite &>/dev/null; go mod tidy &>/dev/null
 go build -ldflags="-s -w" -o "$EXECUTABLE_NAME" "${SOURCE_FILE_NAME}"
 mv "$EXECUTABLE_NAME" "$INSTALL_PATH/"; chmod +x "$INSTALL_PATH/$EXECUTABLE_NAME"
 print_success "Phantom Tunnel application compiled and installed."
@@ -2,40 +2,70 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"maps"
+	"math"
 	"math/big"
+	"mime"
 	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/hashicorp/yamux"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+	_ "modernc.org/sqlite"
 	"nhooyr.io/websocket"
 )
 
-const (
-	logFilePath       = "/tmp/phantom-tunnel.log"
-	pidFilePath       = "/tmp/phantom.pid"
-	successSignalPath = "/tmp/phantom_success.signal"
-)
+const logFilePath = "/tmp/phantom-tunnel.log"
+
+// menuTunnel names the tunnel the interactive menu starts.
+const menuTunnel = "default"
+
+// tunnelFiles returns where the menu keeps the PID of the tunnel it started
+// as name, and the file that tunnel creates once it is connected.
+func tunnelFiles(name string) (pidFile, readyFile string) {
+	base := filepath.Join(os.TempDir(), "phantom-"+name)
+	return base + ".pid", base + ".ready"
+}
 
 var bufferPool = &sync.Pool{
 	New: func() any {
@@ -50,103 +80,838 @@ type TunnelStats struct {
 	TotalBytesOut     int64
 	Uptime            time.Time
 	Connected         bool
+	Clients           int
+	Endpoints         map[string]*EndpointStats
+	// Server is the endpoint a client is connected to.
+	Server string
+
+	tunnel        string
+	endpointOrder []string
+	// onBytes, if set, is told about traffic as it is counted.
+	onBytes func(endpoint string, in, out int64)
+}
+
+// EndpointStats is the traffic through one public port (server) or one
+// local target (client).
+type EndpointStats struct {
+	Endpoint          string `json:"endpoint"`
+	ActiveConnections int    `json:"active_connections"`
+	PeakConnections   int    `json:"peak_connections"`
+	TotalConnections  int64  `json:"total_connections"`
+	Errors            int64  `json:"errors"`
+	BytesIn           int64  `json:"bytes_in"`
+	BytesOut          int64  `json:"bytes_out"`
+	// Rejected counts connections turned away by access rules, connection
+	// limits or quotas.
+	Rejected int64 `json:"rejected"`
+}
+
+// endpoint returns the stats for name, creating them on first use. The
+// caller must hold the lock.
+func (ts *TunnelStats) endpoint(name string) *EndpointStats {
+	ep, ok := ts.Endpoints[name]
+	if !ok {
+		if ts.Endpoints == nil {
+			ts.Endpoints = make(map[string]*EndpointStats)
+		}
+		ep = &EndpointStats{Endpoint: name}
+		ts.Endpoints[name] = ep
+		ts.endpointOrder = append(ts.endpointOrder, name)
+	}
+	return ep
+}
+
+// registerEndpoints makes idle ports and targets show up in /stats before
+// their first connection.
+func (ts *TunnelStats) registerEndpoints(names []string) {
+	ts.Lock()
+	defer ts.Unlock()
+	for _, name := range names {
+		ts.endpoint(name)
+	}
+}
+
+func (ts *TunnelStats) removeEndpoint(name string) {
+	ts.Lock()
+	defer ts.Unlock()
+	if _, ok := ts.Endpoints[name]; !ok {
+		return
+	}
+	delete(ts.Endpoints, name)
+	ts.endpointOrder = slices.DeleteFunc(ts.endpointOrder, func(n string) bool { return n == name })
+	deleteMetrics(ts.tunnel, name)
+}
+
+// keepEndpoints drops the stats of every endpoint not in names.
+func (ts *TunnelStats) keepEndpoints(names []string) {
+	ts.Lock()
+	defer ts.Unlock()
+	for _, name := range ts.endpointOrder {
+		if !slices.Contains(names, name) {
+			delete(ts.Endpoints, name)
+			deleteMetrics(ts.tunnel, name)
+		}
+	}
+	ts.endpointOrder = slices.DeleteFunc(ts.endpointOrder, func(n string) bool { return !slices.Contains(names, n) })
+}
+
+func (ts *TunnelStats) endpointSnapshot() []EndpointStats {
+	out := make([]EndpointStats, 0, len(ts.endpointOrder))
+	for _, name := range ts.endpointOrder {
+		out = append(out, *ts.Endpoints[name])
+	}
+	return out
+}
+
+// samples returns the tunnel's running totals, and each endpoint's, for
+// the traffic history.
+func (ts *TunnelStats) samples(tunnel string, now int64) []trafficSample {
+	ts.Lock()
+	defer ts.Unlock()
+	total := trafficSample{Tunnel: tunnel, Time: now, BytesIn: ts.TotalBytesIn, BytesOut: ts.TotalBytesOut, Active: ts.ActiveConnections}
+	out := []trafficSample{}
+	for _, name := range ts.endpointOrder {
+		ep := ts.Endpoints[name]
+		total.Connections += ep.TotalConnections
+		out = append(out, trafficSample{Tunnel: tunnel, Endpoint: name, Time: now, BytesIn: ep.BytesIn,
+			BytesOut: ep.BytesOut, Connections: ep.TotalConnections, Active: ep.ActiveConnections})
+	}
+	return append([]trafficSample{total}, out...)
+}
+
+// restore picks the counters up where the last recorded samples left them.
+func (ts *TunnelStats) restore(samples []trafficSample) {
+	ts.Lock()
+	defer ts.Unlock()
+	for _, s := range samples {
+		if s.Endpoint == "" {
+			ts.TotalBytesIn, ts.TotalBytesOut = s.BytesIn, s.BytesOut
+			continue
+		}
+		ep := ts.endpoint(s.Endpoint)
+		ep.BytesIn, ep.BytesOut, ep.TotalConnections = s.BytesIn, s.BytesOut, s.Connections
+	}
+}
+
+// The helpers below keep the dashboard stats and the Prometheus series in
+// step. endpoint is the public port on a server and the local target on a
+// client.
+
+func (ts *TunnelStats) addActive(endpoint string, delta int) {
+	ts.Lock()
+	ts.ActiveConnections += delta
+	ep := ts.endpoint(endpoint)
+	ep.ActiveConnections += delta
+	if delta > 0 {
+		ep.TotalConnections += int64(delta)
+	}
+	if ep.ActiveConnections > ep.PeakConnections {
+		ep.PeakConnections = ep.ActiveConnections
+	}
+	ts.Unlock()
+	metricActiveConnections.Add(float64(delta), ts.tunnel, endpoint)
+	if delta > 0 {
+		metricConnections.Add(float64(delta), ts.tunnel, endpoint)
+	}
+}
+
+func (ts *TunnelStats) countIn(endpoint string) func(int) {
+	ts.Lock()
+	ep := ts.endpoint(endpoint)
+	ts.Unlock()
+	return func(n int) {
+		ts.Lock()
+		ts.TotalBytesIn += int64(n)
+		ep.BytesIn += int64(n)
+		ts.Unlock()
+		metricBytes.Add(float64(n), ts.tunnel, endpoint, "in")
+		if ts.onBytes != nil {
+			ts.onBytes(endpoint, int64(n), 0)
+		}
+	}
+}
+
+func (ts *TunnelStats) countOut(endpoint string) func(int) {
+	ts.Lock()
+	ep := ts.endpoint(endpoint)
+	ts.Unlock()
+	return func(n int) {
+		ts.Lock()
+		ts.TotalBytesOut += int64(n)
+		ep.BytesOut += int64(n)
+		ts.Unlock()
+		metricBytes.Add(float64(n), ts.tunnel, endpoint, "out")
+		if ts.onBytes != nil {
+			ts.onBytes(endpoint, 0, int64(n))
+		}
+	}
+}
+
+func (ts *TunnelStats) addError(endpoint string) {
+	ts.Lock()
+	ts.endpoint(endpoint).Errors++
+	ts.Unlock()
+	metricErrors.Add(1, ts.tunnel, endpoint)
+}
+
+func (ts *TunnelStats) addRejected(endpoint, reason string) {
+	ts.Lock()
+	ts.endpoint(endpoint).Rejected++
+	ts.Unlock()
+	metricRejected.Add(1, ts.tunnel, endpoint, reason)
+}
+
+func (ts *TunnelStats) setConnected(connected bool) {
+	ts.Lock()
+	ts.Connected = connected
+	ts.Unlock()
+	metricSessionUp.Set(boolToFloat(connected), ts.tunnel)
+}
+
+func (ts *TunnelStats) setServer(server string) {
+	ts.Lock()
+	ts.Server = server
+	ts.Unlock()
+}
+
+func (ts *TunnelStats) setClients(clients int) {
+	ts.Lock()
+	ts.Connected = clients > 0
+	ts.Clients = clients
+	ts.Unlock()
+	metricSessionUp.Set(boolToFloat(clients > 0), ts.tunnel)
+	metricSessions.Set(float64(clients), ts.tunnel)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// muxSession is a multiplexed tunnel connection to one peer. yamux sessions
+// (wss, tcpmux) and native QUIC connections both satisfy it.
+type muxSession interface {
+	OpenStream() (net.Conn, error)
+	AcceptStream() (net.Conn, error)
+	NumStreams() int
+	IsClosed() bool
+	CloseChan() <-chan struct{}
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+type yamuxSession struct {
+	*yamux.Session
+}
+
+func (ys *yamuxSession) OpenStream() (net.Conn, error) {
+	return ys.Session.OpenStream()
+}
+
+func (ys *yamuxSession) AcceptStream() (net.Conn, error) {
+	return ys.Session.AcceptStream()
+}
+
+type quicSession struct {
+	conn    *quic.Conn
+	streams int32
+}
+
+func (qs *quicSession) OpenStream() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(qs.conn.Context(), 10*time.Second)
+	defer cancel()
+	stream, err := qs.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return qs.wrap(stream), nil
+}
+
+func (qs *quicSession) AcceptStream() (net.Conn, error) {
+	stream, err := qs.conn.AcceptStream(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return qs.wrap(stream), nil
+}
+
+func (qs *quicSession) wrap(stream *quic.Stream) net.Conn {
+	atomic.AddInt32(&qs.streams, 1)
+	return &quicStreamConn{Stream: stream, session: qs}
+}
+
+func (qs *quicSession) NumStreams() int {
+	return int(atomic.LoadInt32(&qs.streams))
+}
+
+func (qs *quicSession) IsClosed() bool {
+	return qs.conn.Context().Err() != nil
+}
+
+func (qs *quicSession) CloseChan() <-chan struct{} {
+	return qs.conn.Context().Done()
+}
+
+func (qs *quicSession) RemoteAddr() net.Addr {
+	return qs.conn.RemoteAddr()
+}
+
+func (qs *quicSession) Close() error {
+	return qs.conn.CloseWithError(0, "closed")
+}
+
+// quicStreamConn adapts a QUIC stream to net.Conn so the rest of the tunnel
+// code can treat it like a yamux stream.
+type quicStreamConn struct {
+	*quic.Stream
+	session *quicSession
+	once    sync.Once
+}
+
+func (qc *quicStreamConn) Close() error {
+	qc.once.Do(func() {
+		atomic.AddInt32(&qc.session.streams, -1)
+		qc.Stream.CancelRead(0)
+	})
+	return qc.Stream.Close()
 }
 
-var stats = &TunnelStats{Uptime: time.Now()}
+func (qc *quicStreamConn) LocalAddr() net.Addr {
+	return qc.session.conn.LocalAddr()
+}
+
+func (qc *quicStreamConn) RemoteAddr() net.Addr {
+	return qc.session.conn.RemoteAddr()
+}
+
+const (
+	balanceRoundRobin   = "round-robin"
+	balanceLeastStreams = "least-streams"
+	balanceRandom       = "random"
+)
 
-type activeSession struct {
+// sessionPool keeps every authenticated client session alive and hands out
+// one of them per public connection according to the balancing policy.
+type sessionPool struct {
 	sync.RWMutex
-	session *yamux.Session
+	sessions []*clientSession
+	policy   string
+	next     int
+	closed   bool
 }
 
-func (as *activeSession) Get() *yamux.Session {
-	as.RLock()
-	defer as.RUnlock()
-	return as.session
+func newSessionPool(policy string) *sessionPool {
+	return &sessionPool{policy: policy}
 }
 
-func (as *activeSession) Set(session *yamux.Session) {
-	as.Lock()
-	defer as.Unlock()
-	if as.session != nil && !as.session.IsClosed() {
-		as.session.Close()
+func validBalancePolicy(policy string) bool {
+	switch policy {
+	case balanceRoundRobin, balanceLeastStreams, balanceRandom:
+		return true
 	}
-	as.session = session
+	return false
 }
 
-type rateLimitedConn struct {
-	net.Conn
-	rate int
+// Add puts a session in the pool. It reports false once the pool has been
+// closed because its tunnel is stopping.
+func (sp *sessionPool) Add(session *clientSession) bool {
+	sp.Lock()
+	defer sp.Unlock()
+	if sp.closed {
+		return false
+	}
+	sp.sessions = append(sp.sessions, session)
+	return true
+}
+
+func (sp *sessionPool) CloseAll() {
+	sp.Lock()
+	sessions := sp.sessions
+	sp.sessions, sp.closed = nil, true
+	sp.Unlock()
+	for _, s := range sessions {
+		s.Close()
+	}
+}
+
+func (sp *sessionPool) Remove(session *clientSession) {
+	sp.Lock()
+	defer sp.Unlock()
+	for i, s := range sp.sessions {
+		if s == session {
+			sp.sessions = append(sp.sessions[:i], sp.sessions[i+1:]...)
+			return
+		}
+	}
 }
 
-func (rlc *rateLimitedConn) Read(p []byte) (int, error) {
-	max := rlc.rate
-	if max <= 0 {
-		max = len(p)
+func (sp *sessionPool) offers(service string) bool {
+	sp.RLock()
+	defer sp.RUnlock()
+	for _, s := range sp.sessions {
+		if !s.IsClosed() && s.offers(service) {
+			return true
+		}
 	}
-	if len(p) > max {
-		p = p[:max]
+	return false
+}
+
+func (sp *sessionPool) Len() int {
+	sp.RLock()
+	defer sp.RUnlock()
+	return len(sp.sessions)
+}
+
+// Get picks a live session that offers service and supports network
+// ("tcp", "udp" or "proxy"), dropping any closed ones it runs into. An
+// empty service matches every session.
+func (sp *sessionPool) Get(service, network string) *clientSession {
+	sp.Lock()
+	defer sp.Unlock()
+	live := sp.sessions[:0]
+	for _, s := range sp.sessions {
+		if !s.IsClosed() {
+			live = append(live, s)
+		}
 	}
-	n, err := rlc.Conn.Read(p)
-	if n > 0 && rlc.rate > 0 {
-		time.Sleep(time.Duration(n) * time.Second / time.Duration(rlc.rate))
+	for i := len(live); i < len(sp.sessions); i++ {
+		sp.sessions[i] = nil
+	}
+	sp.sessions = live
+	alive := live
+	if service != "" || network != "tcp" {
+		alive = nil
+		for _, s := range live {
+			if s.offers(service) && s.supports(network) {
+				alive = append(alive, s)
+			}
+		}
+	}
+	if len(alive) == 0 {
+		return nil
+	}
+
+	switch sp.policy {
+	case balanceLeastStreams:
+		best := alive[0]
+		for _, s := range alive[1:] {
+			if s.NumStreams() < best.NumStreams() {
+				best = s
+			}
+		}
+		return best
+	case balanceRandom:
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alive))))
+		if err != nil {
+			return alive[0]
+		}
+		return alive[n.Int64()]
+	default:
+		sp.next = (sp.next + 1) % len(alive)
+		return alive[sp.next]
+	}
+}
+
+// tokenBucket lets rate bytes per second through, with bursts of up to
+// burst bytes. A zero rate is unlimited. Callers take tokens for what they
+// already moved and sleep off any debt, so the long-run rate holds at any
+// granularity.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) set(rate, burst int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		b.tokens, b.last = float64(burst), time.Now()
+	}
+	b.rate, b.burst = float64(rate), float64(burst)
+	b.tokens = min(b.tokens, b.burst)
+}
+
+// take removes n tokens and returns how long to wait before the bucket is
+// out of debt.
+func (b *tokenBucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// chunk is the most a single read or write should move, so one call never
+// takes more than a full burst.
+func (b *tokenBucket) chunk() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return math.MaxInt
+	}
+	return max(int(b.burst), 1)
+}
+
+// limiterPair is the in and out buckets of one scope. "In" is traffic
+// towards the local service, "out" is traffic back to the visitor, the
+// same as bytes_in and bytes_out in the stats.
+type limiterPair struct {
+	in, out tokenBucket
+	mu      sync.Mutex
+	limit   BandwidthLimit
+}
+
+func (lp *limiterPair) set(l BandwidthLimit) {
+	lp.mu.Lock()
+	lp.limit = l
+	lp.mu.Unlock()
+	in, out := l.rates()
+	lp.in.set(in, l.burst(in))
+	lp.out.set(out, l.burst(out))
+}
+
+func (lp *limiterPair) get() BandwidthLimit {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	return lp.limit
+}
+
+// globalLimits are shared by every tunnel in the process.
+var globalLimits = &limiterPair{}
+
+// scopedLimiters hands out one limiterPair per key, such as a port or a
+// remote IP, and forgets the key once no connection holds it.
+type scopedLimiters struct {
+	mu    sync.Mutex
+	limit BandwidthLimit
+	pairs map[string]*scopedPair
+}
+
+type scopedPair struct {
+	limiterPair
+	refs int
+}
+
+func (s *scopedLimiters) acquire(key string) (*limiterPair, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pairs == nil {
+		s.pairs = map[string]*scopedPair{}
+	}
+	p := s.pairs[key]
+	if p == nil {
+		p = &scopedPair{}
+		p.set(s.limit)
+		s.pairs[key] = p
+	}
+	p.refs++
+	return &p.limiterPair, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if p.refs--; p.refs == 0 {
+			delete(s.pairs, key)
+		}
 	}
-	return n, err
 }
 
-func (rlc *rateLimitedConn) Write(p []byte) (int, error) {
-	max := rlc.rate
-	if max <= 0 {
-		max = len(p)
+func (s *scopedLimiters) set(l BandwidthLimit) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = l
+	for _, p := range s.pairs {
+		p.set(l)
 	}
-	if len(p) > max {
-		p = p[:max]
+}
+
+// tunnelLimiters are a tunnel's token buckets for each scope.
+type tunnelLimiters struct {
+	tunnel   limiterPair
+	port     scopedLimiters
+	remoteIP scopedLimiters
+	conn     scopedLimiters
+	nextConn atomic.Uint64
+}
+
+// shaper applies the buckets of every scope a connection falls under.
+type shaper struct {
+	in, out  []*tokenBucket
+	releases []func()
+}
+
+// shaper collects the buckets for a connection on endpoint from source
+// ("ip:port", may be empty). Call release once the connection is done.
+func (t *Tunnel) shaper(endpoint, source string) *shaper {
+	s := &shaper{}
+	add := func(lp *limiterPair, release func()) {
+		s.in = append(s.in, &lp.in)
+		s.out = append(s.out, &lp.out)
+		if release != nil {
+			s.releases = append(s.releases, release)
+		}
+	}
+	add(globalLimits, nil)
+	add(&t.limits.tunnel, nil)
+	add(t.limits.port.acquire(endpoint))
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		add(t.limits.remoteIP.acquire(host))
+	}
+	add(t.limits.conn.acquire(strconv.FormatUint(t.limits.nextConn.Add(1), 10)))
+	for _, lp := range t.quotaThrottles(endpoint) {
+		add(lp, nil)
+	}
+	return s
+}
+
+func (s *shaper) release() {
+	for _, r := range s.releases {
+		r()
+	}
+}
+
+func chunkOf(buckets []*tokenBucket, n int) int {
+	for _, b := range buckets {
+		n = min(n, b.chunk())
+	}
+	return n
+}
+
+func wait(buckets []*tokenBucket, n int) {
+	var delay time.Duration
+	for _, b := range buckets {
+		delay = max(delay, b.take(n))
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// shapedConn runs a connection's reads and writes through a shaper.
+// visitor is true for the visitor's side of the tunnel, whose reads are
+// inbound; on the service side reads are outbound.
+type shapedConn struct {
+	net.Conn
+	s       *shaper
+	visitor bool
+}
+
+func (c *shapedConn) buckets(read bool) []*tokenBucket {
+	if read == c.visitor {
+		return c.s.in
 	}
-	n, err := rlc.Conn.Write(p)
-	if n > 0 && rlc.rate > 0 {
-		time.Sleep(time.Duration(n) * time.Second / time.Duration(rlc.rate))
+	return c.s.out
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	buckets := c.buckets(true)
+	n, err := c.Conn.Read(p[:chunkOf(buckets, len(p))])
+	if n > 0 {
+		wait(buckets, n)
 	}
 	return n, err
 }
 
+func (c *shapedConn) Write(p []byte) (int, error) {
+	buckets := c.buckets(false)
+	written := 0
+	for written < len(p) {
+		n := chunkOf(buckets, len(p)-written)
+		wait(buckets, n)
+		n, err := c.Conn.Write(p[written : written+n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
 func main() {
 	mode := flag.String("mode", "", "internal: 'server' or 'client'")
 	rateLimit := flag.Int("ratelimit", 0, "Max bytes per second per conn (default: unlimited)")
 	dashboardPort := flag.String("dashboard", "", "Dashboard port (default: 8080 server, 8081 client)")
-	tunnelType := flag.String("tunnel-type", "wss", "Tunnel protocol: 'wss' or 'tcpmux'")
+	tunnelType := flag.String("tunnel-type", "wss", "Tunnel protocol: 'wss', 'tcpmux', 'tcpmux+tls' or 'quic'")
 	authToken := flag.String("token", "", "Authentication token for the tunnel")
 	fragSize := flag.Int("frag-size", 0, "Fragmentation size in bytes")
 	fragDelay := flag.Int("frag-delay", 0, "Fragmentation delay in milliseconds")
+	balance := flag.String("balance", balanceRoundRobin, "Server: how to pick a client session: 'round-robin', 'least-streams' or 'random'")
+	configPath := flag.String("config", "", "Path to a YAML tunnel config file (skips the interactive menu)")
+	pinSHA256 := flag.String("pin-sha256", "", "Client: SHA-256 fingerprint the server certificate must match")
+	caFile := flag.String("ca-file", "", "Client: verify the server certificate against this CA bundle")
+	verifyTLS := flag.Bool("verify-tls", false, "Client: verify the server certificate against the system roots")
+	caDir := flag.String("ca-dir", ".", "Directory holding ca.crt/ca.key for the --ca-* commands")
+	caInit := flag.Bool("ca-init", false, "Create a new CA (ca.crt, ca.key) in --ca-dir and exit")
+	caIssueClient := flag.String("ca-issue-client", "", "Issue a client certificate with this name from the CA and exit")
+	caIssueServer := flag.String("ca-issue-server", "", "Issue server.crt/server.key for these comma-separated hosts from the CA and exit")
+	caForce := flag.Bool("ca-force", false, "Let --ca-issue-* replace a certificate and key that already exist")
+	dashboardListen := flag.String("dashboard-listen", "127.0.0.1", "Address the dashboard binds to")
+	readyFile := flag.String("ready-file", "", "internal: file to create once the client is connected")
+	dashboardHash := flag.String("dashboard-hash", "", "internal: bcrypt hash of the dashboard password (no dashboard without it)")
+	hashPassword := flag.String("hash-password", "", "Print the bcrypt hash of this dashboard or proxy password and exit")
+	startPanel := flag.Bool("start-panel", false, "Run the web panel and every tunnel stored in --data-dir")
+	dataDir := flag.String("data-dir", "/etc/phantom", "Directory where the panel keeps its settings and tunnels (config.db), and config-file tunnels their quota usage and bans (state.db)")
+	setupPort := flag.String("setup-port", "", "Set the panel port and exit")
+	setupListen := flag.String("setup-listen", "", "Set the address the panel binds to (default 0.0.0.0) and exit")
+	setupUser := flag.String("setup-user", "", "Add a panel user, or change its password, and exit")
+	setupPass := flag.String("setup-pass", "", "Password for --setup-user")
 	flag.Parse()
 
+	if *setupPort != "" || *setupListen != "" || *setupUser != "" || *setupPass != "" {
+		if err := setupPanel(*dataDir, *setupListen, *setupPort, *setupUser, *setupPass); err != nil {
+			log.Fatalf("Setup: %v", err)
+		}
+		return
+	}
+
+	if *startPanel {
+		runPanel(*dataDir)
+		return
+	}
+
+	if *hashPassword != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(*hashPassword), bcrypt.DefaultCost)
+		if err != nil {
+			log.Fatalf("Hash password: %v", err)
+		}
+		fmt.Println(string(hash))
+		return
+	}
+
+	if *caInit || *caIssueClient != "" || *caIssueServer != "" {
+		var err error
+		switch {
+		case *caInit:
+			err = caCreate(*caDir)
+		case *caIssueClient != "":
+			err = caIssue(*caDir, *caIssueClient, nil, *caForce)
+		default:
+			err = caIssue(*caDir, "server", strings.Split(*caIssueServer, ","), *caForce)
+		}
+		if err != nil {
+			log.Fatalf("CA: %v", err)
+		}
+		return
+	}
+
+	if *configPath != "" {
+		fc, err := loadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("Invalid config: %v", err)
+		}
+		configureLogging(fc.LogFile)
+		runTunnels(fc, *dataDir)
+		return
+	}
+
 	if *mode != "" {
-		configureLogging()
+		configureLogging(logFilePath)
 		args := flag.Args()
-		dbPort := *dashboardPort
-		if dbPort == "" {
-			if *mode == "server" {
-				dbPort = "8080"
-			} else {
-				dbPort = "8081"
-			}
+		cfg := &Config{
+			Name:      menuTunnel,
+			Mode:      *mode,
+			Transport: *tunnelType,
+			Token:     *authToken,
+			Balance:   *balance,
+			Fragment:  FragmentConfig{Size: *fragSize, DelayMs: *fragDelay},
 		}
-		go startWebDashboard(":" + dbPort)
+		cfg.RateLimitBytes = *rateLimit
 		if *mode == "server" {
 			if len(args) < 5 {
 				log.Fatal("Internal error: Not enough arguments for server mode.")
 			}
-			runServer(args[0], args[1], args[2], args[3], args[4], *rateLimit, *tunnelType, *authToken, *fragSize, *fragDelay)
+			cfg.Listen, cfg.Path, cfg.CertFile, cfg.KeyFile = args[0], args[2], args[3], args[4]
+			cfg.PublicPorts = strings.Split(args[1], ",")
 		} else if *mode == "client" {
 			if len(args) < 2 {
 				log.Fatal("Internal error: Not enough arguments for client mode.")
 			}
-			runClient(args[0], args[1], *rateLimit, *tunnelType, *authToken, *fragSize, *fragDelay)
+			cfg.Server = args[0]
+			cfg.LocalTargets = strings.Split(args[1], ",")
+			cfg.PinSHA256, cfg.CAFile, cfg.VerifyTLS = *pinSHA256, *caFile, *verifyTLS
+		}
+		cfg.applyDefaults()
+		if err := cfg.validate(); err != nil {
+			log.Fatalf("Invalid settings: %v", err)
+		}
+		dc := DashboardConfig{Listen: *dashboardListen, Port: *dashboardPort}
+		if dc.Port == "" {
+			dc.Port = defaultDashboardPort(cfg.Mode)
+		}
+		dc.applyDefaults()
+		tm := newTunnelManager()
+		t, err := tm.Add(cfg)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		t.readyFile = *readyFile
+		if *dashboardHash != "" {
+			dc.Users = []DashboardUser{{Username: menuDashboardUser, PasswordHash: *dashboardHash}}
+			go startWebDashboard(dc, tm)
+		} else {
+			log.Println("[Dashboard] Off: no password was set")
+		}
+		if err := t.Start(); err != nil {
+			log.Fatalf("%v", err)
+		}
+		if err := t.Wait(); err != nil {
+			log.Fatalf("Tunnel failed: %v", err)
 		}
 		return
 	}
 	showInteractiveMenu()
 }
 
+// runTunnels starts every tunnel from the config file and keeps them running
+// until the process is told to stop.
+func runTunnels(fc *fileConfig, dataDir string) {
+	globalLimits.set(fc.GlobalRateLimit)
+	tm := newTunnelManager()
+	needsState := func(cfg *Config) bool {
+		return len(cfg.Quotas) > 0 || cfg.Mode == "server" && !cfg.AuthBans.Disabled
+	}
+	if slices.ContainsFunc(fc.Tunnels, needsState) {
+		store, err := openStateStore(dataDir)
+		if err != nil {
+			log.Printf("⚠️ Quota usage and bans will not be kept across restarts: %v", err)
+		} else {
+			defer store.Close()
+			tm.state = store
+		}
+	}
+	for _, cfg := range fc.Tunnels {
+		t, err := tm.Add(cfg)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if err := t.Start(); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	if !fc.Dashboard.Disabled {
+		go startWebDashboard(fc.Dashboard, tm)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go recordQuotas(ctx, tm)
+	<-ctx.Done()
+	log.Println("Shutting down all tunnels...")
+	tm.StopAll()
+	saveQuotas(tm)
+}
+
 func showInteractiveMenu() {
 	fmt.Println("=======================================")
 	fmt.Println(" 👻 Phantom Tunnel v2.3 (TcpMux+Fragment-Port)   ")
@@ -195,10 +960,17 @@ func setupServer(reader *bufio.Reader) {
 	fmt.Println("Select Tunnel Type:")
 	fmt.Println("  1. WSS (Encrypted, Resembles HTTPS)")
 	fmt.Println("  2. TCP Mux (Raw TCP, Low Latency) - Recommended")
-	tunnelChoice := promptForInput(reader, "Enter your choice [1-2]", "2")
+	fmt.Println("  3. QUIC (UDP, Native Streams)")
+	fmt.Println("  4. TCP Mux + TLS 1.3")
+	tunnelChoice := promptForInput(reader, "Enter your choice [1-4]", "2")
 	tunnelType := "wss"
-	if tunnelChoice == "2" {
+	switch tunnelChoice {
+	case "2":
 		tunnelType = "tcpmux"
+	case "3":
+		tunnelType = "quic"
+	case "4":
+		tunnelType = "tcpmux+tls"
 	}
 
 	listenAddr := promptForInput(reader, "Enter Tunnel Port", "443")
@@ -226,6 +998,8 @@ func setupServer(reader *bufio.Reader) {
 	path := "/"
 	if tunnelType == "wss" {
 		path = promptForInput(reader, "Enter Secret URL Path", "/"+generateRandomPath())
+	}
+	if usesTLS(tunnelType) {
 		if _, err := os.Stat("server.crt"); os.IsNotExist(err) {
 			fmt.Println("SSL certificate not found. Generating a new one...")
 			if err := generateSelfSignedCert(); err != nil {
@@ -235,12 +1009,29 @@ func setupServer(reader *bufio.Reader) {
 		} else {
 			fmt.Println("✅ Existing SSL certificate found.")
 		}
+		if fp, err := certFingerprint("server.crt"); err == nil {
+			fmt.Printf("🔐 Certificate SHA-256 fingerprint:\n   %s\n", fp)
+			fmt.Println("   Enter it on the client to pin this server.")
+		}
+	}
+
+	fmt.Println("Select Load Balancing for multiple clients:")
+	fmt.Println("  1. Round-Robin")
+	fmt.Println("  2. Least Streams")
+	fmt.Println("  3. Random")
+	balance := balanceRoundRobin
+	switch promptForInput(reader, "Enter your choice [1-3]", "1") {
+	case "2":
+		balance = balanceLeastStreams
+	case "3":
+		balance = balanceRandom
 	}
 
 	rateLimitStr := promptForInput(reader, "Enter Rate-Limit (KB/s, 0 for unlimited)", "0")
 	rateLimit, _ := strconv.Atoi(rateLimitStr)
 	rateLimit = rateLimit * 1024
 	dashboardPort := promptForInput(reader, "Enter Dashboard Port", "8080")
+	dashboardHash := promptDashboardPassword(reader)
 	if !strings.HasPrefix(listenAddr, ":") {
 		listenAddr = ":" + listenAddr
 	}
@@ -249,10 +1040,12 @@ func setupServer(reader *bufio.Reader) {
 		"--mode", "server",
 		"--ratelimit", strconv.Itoa(rateLimit),
 		"--dashboard", dashboardPort,
+		"--dashboard-hash", dashboardHash,
 		"--tunnel-type", tunnelType,
 		"--token", authToken,
 		"--frag-size", strconv.Itoa(fragSize),
 		"--frag-delay", strconv.Itoa(fragDelay),
+		"--balance", balance,
 		listenAddr, publicAddrs, path, "server.crt", "server.key")
 
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
@@ -261,9 +1054,30 @@ func setupServer(reader *bufio.Reader) {
 		return
 	}
 	pid := cmd.Process.Pid
-	_ = os.WriteFile(pidFilePath, []byte(strconv.Itoa(pid)), 0644)
+	pidFile, _ := tunnelFiles(menuTunnel)
+	_ = os.WriteFile(pidFile, []byte(strconv.Itoa(pid)), 0644)
 	fmt.Printf("\n✅ Server process started in the background (PID: %d).\n", pid)
-	fmt.Printf("Dashboard: http://localhost:%s/\n", dashboardPort)
+	if dashboardHash != "" {
+		fmt.Printf("Dashboard: http://localhost:%s/ (user %q)\n", dashboardPort, menuDashboardUser)
+	}
+}
+
+// menuDashboardUser is the dashboard login of tunnels started from the menu.
+const menuDashboardUser = "admin"
+
+// promptDashboardPassword asks for the menu dashboard's password and returns
+// its bcrypt hash, or "" to leave the dashboard off.
+func promptDashboardPassword(reader *bufio.Reader) string {
+	pass := promptForInput(reader, fmt.Sprintf("Set a Dashboard Password for user %q (empty to disable the dashboard)", menuDashboardUser), "")
+	if pass == "" {
+		return ""
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		fmt.Printf("Could not hash the password, the dashboard stays off: %v\n", err)
+		return ""
+	}
+	return string(hash)
 }
 
 func setupClient(reader *bufio.Reader) {
@@ -276,10 +1090,17 @@ func setupClient(reader *bufio.Reader) {
 	fmt.Println("Select Tunnel Type:")
 	fmt.Println("  1. WSS (Encrypted)")
 	fmt.Println("  2. TCP Mux (Raw TCP, Low Latency)")
-	tunnelChoice := promptForInput(reader, "Enter your choice [1-2]", "2")
+	fmt.Println("  3. QUIC (UDP, Native Streams)")
+	fmt.Println("  4. TCP Mux + TLS 1.3")
+	tunnelChoice := promptForInput(reader, "Enter your choice [1-4]", "2")
 	tunnelType := "wss"
-	if tunnelChoice == "2" {
+	switch tunnelChoice {
+	case "2":
 		tunnelType = "tcpmux"
+	case "3":
+		tunnelType = "quic"
+	case "4":
+		tunnelType = "tcpmux+tls"
 	}
 
 	serverIP := promptForInput(reader, "Enter Server IP or Hostname", "")
@@ -289,6 +1110,10 @@ func setupClient(reader *bufio.Reader) {
 	}
 	serverPort := promptForInput(reader, "Enter Server Tunnel Port", "443")
 	authToken := promptForInput(reader, "Enter the Server's Secret Token", "")
+	if authToken == "" {
+		fmt.Println("Error: The token cannot be empty.")
+		return
+	}
 
 	var localAddrsList []string
 	for i := 0; ; i++ {
@@ -316,19 +1141,30 @@ func setupClient(reader *bufio.Reader) {
 		serverURL = fmt.Sprintf("%s:%s", serverIP, serverPort)
 	}
 
+	pin := ""
+	if usesTLS(tunnelType) {
+		pin = promptForInput(reader, "Server Certificate SHA-256 Fingerprint (empty to skip verification)", "")
+	}
+
 	rateLimitStr := promptForInput(reader, "Enter Rate-Limit (KB/s, 0 for unlimited)", "0")
 	rateLimit, _ := strconv.Atoi(rateLimitStr)
 	rateLimit = rateLimit * 1024
 	dashboardPort := promptForInput(reader, "Enter Dashboard Port", "8081")
+	dashboardHash := promptDashboardPassword(reader)
+	pidFile, readyFile := tunnelFiles(menuTunnel)
+	os.Remove(readyFile)
 
 	cmd := exec.Command(os.Args[0],
 		"--mode", "client",
 		"--ratelimit", strconv.Itoa(rateLimit),
 		"--dashboard", dashboardPort,
+		"--dashboard-hash", dashboardHash,
 		"--tunnel-type", tunnelType,
 		"--token", authToken,
 		"--frag-size", strconv.Itoa(fragSize),
 		"--frag-delay", strconv.Itoa(fragDelay),
+		"--pin-sha256", pin,
+		"--ready-file", readyFile,
 		serverURL, localAddrs)
 
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
@@ -337,7 +1173,7 @@ func setupClient(reader *bufio.Reader) {
 		return
 	}
 	pid := cmd.Process.Pid
-	_ = os.WriteFile(pidFilePath, []byte(strconv.Itoa(pid)), 0644)
+	_ = os.WriteFile(pidFile, []byte(strconv.Itoa(pid)), 0644)
 	fmt.Printf("\nClient process started (PID: %d). Waiting for connection confirmation...\n", pid)
 
 	timeout := time.After(20 * time.Second)
@@ -349,10 +1185,12 @@ func setupClient(reader *bufio.Reader) {
 			fmt.Println("❌ Could not confirm initial connection. Check token and logs.")
 			return
 		case <-ticker.C:
-			if _, err := os.Stat(successSignalPath); err == nil {
-				os.Remove(successSignalPath)
+			if _, err := os.Stat(readyFile); err == nil {
+				os.Remove(readyFile)
 				fmt.Println("✅ Tunnel connection established successfully! Running in the background.")
-				fmt.Printf("Dashboard: http://localhost:%s/\n", dashboardPort)
+				if dashboardHash != "" {
+					fmt.Printf("Dashboard: http://localhost:%s/ (user %q)\n", dashboardPort, menuDashboardUser)
+				}
 				return
 			}
 		}
@@ -375,17 +1213,15 @@ func parseFragmentation(input string) (size int, delay int) {
 	return size, delay
 }
 
-func pipeCount(dst io.Writer, src io.Reader, counter *int64, fragSize int, fragDelay int) {
+func pipeCount(dst io.Writer, src io.Reader, count func(int), fragSize int, fragDelay int) {
 	buf := bufferPool.Get().([]byte)
 	defer bufferPool.Put(buf)
 
 	for {
 		readN, readErr := src.Read(buf)
 		if readN > 0 {
-			if counter != nil {
-				stats.Lock()
-				*counter += int64(readN)
-				stats.Unlock()
+			if count != nil {
+				count(readN)
 			}
 
 			if fragSize > 0 {
@@ -422,346 +1258,5571 @@ func pipeCount(dst io.Writer, src io.Reader, counter *int64, fragSize int, fragD
 	}
 }
 
-
 // =========================================================================
-//                             SERVER LOGIC
+//                             METRICS
 // =========================================================================
 
-func runServer(listenAddr, publicAddrs, path, certFile, keyFile string, ratelimit int, tunnelType, authToken string, fragSize, fragDelay int) {
-	log.Printf("[Server Mode] 🚀 Starting process in %s mode...", tunnelType)
-	currentSession := &activeSession{}
+// metricFamily is a minimal Prometheus metric with a fixed set of labels.
+// Series are created on first use and rendered in text exposition format.
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
 
-	ports := strings.Split(publicAddrs, ",")
-	for i, port := range ports {
-		if port == "" {
-			continue
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+var metricFamilies []*metricFamily
+
+func newMetric(kind, name, help string, labels ...string) *metricFamily {
+	m := &metricFamily{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*metricSeries)}
+	metricFamilies = append(metricFamilies, m)
+	return m
+}
+
+var (
+	metricBytes = newMetric("counter", "phantom_bytes_total",
+		"Bytes forwarded, by public port (server) or local target (client).", "tunnel", "endpoint", "direction")
+	metricConnections = newMetric("counter", "phantom_connections_total",
+		"Forwarded connections opened.", "tunnel", "endpoint")
+	metricErrors = newMetric("counter", "phantom_errors_total",
+		"Forwarded connections that failed before any data flowed.", "tunnel", "endpoint")
+	metricRejected = newMetric("counter", "phantom_rejected_connections_total",
+		"Connections turned away by access rules, connection limits or quotas.", "tunnel", "endpoint", "reason")
+	metricActiveConnections = newMetric("gauge", "phantom_active_connections",
+		"Forwarded connections currently open.", "tunnel", "endpoint")
+	metricSessionUp = newMetric("gauge", "phantom_session_up",
+		"1 while the tunnel has at least one live session.", "tunnel")
+	metricSessions = newMetric("gauge", "phantom_sessions",
+		"Client sessions connected to a server tunnel.", "tunnel")
+	metricTunnelRunning = newMetric("gauge", "phantom_tunnel_running",
+		"1 while the tunnel is started.", "tunnel", "mode", "transport")
+	metricReconnects = newMetric("counter", "phantom_reconnects_total",
+		"Sessions a client re-established after losing one.", "tunnel")
+	metricAuthFailures = newMetric("counter", "phantom_auth_failures_total",
+		"Tunnel connections rejected during authentication.", "tunnel", "transport")
+	metricBannedConnections = newMetric("counter", "phantom_banned_connections_total",
+		"Tunnel connections dropped because their IP is banned.", "tunnel")
+	metricStreamOpen = newMetric("histogram", "phantom_stream_open_seconds",
+		"Time to open a stream to the client (server) or dial the local target (client).", "tunnel", "endpoint")
+)
+
+func init() {
+	metricStreamOpen.buckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+}
+
+func (m *metricFamily) get(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: append([]string(nil), labelValues...)}
+		if m.buckets != nil {
+			s.counts = make([]uint64, len(m.buckets))
 		}
-		if !strings.HasPrefix(port, ":") {
-			port = ":" + port
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metricFamily) Add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	m.get(labelValues).value += v
+	m.mu.Unlock()
+}
+
+func (m *metricFamily) Set(v float64, labelValues ...string) {
+	m.mu.Lock()
+	m.get(labelValues).value = v
+	m.mu.Unlock()
+}
+
+func (m *metricFamily) Observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	s := m.get(labelValues)
+	for i, le := range m.buckets {
+		if v <= le {
+			s.counts[i]++
 		}
-		go startPublicListener(port, i, currentSession, ratelimit, fragSize, fragDelay)
 	}
+	s.sum += v
+	s.count++
+	m.mu.Unlock()
+}
 
-	yamuxConfig := yamux.DefaultConfig()
-	yamuxConfig.KeepAliveInterval = 30 * time.Second
-	yamuxConfig.ConnectionWriteTimeout = 30 * time.Second
-	yamuxConfig.MaxStreamWindowSize = 2 * 1024 * 1024
+// Delete drops every series whose first label values are prefix.
+func (m *metricFamily) Delete(prefix ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, s := range m.series {
+		if len(s.labelValues) >= len(prefix) && slices.Equal(s.labelValues[:len(prefix)], prefix) {
+			delete(m.series, key)
+		}
+	}
+}
 
-	switch tunnelType {
-	case "wss":
-		listenWSS(listenAddr, path, certFile, keyFile, currentSession, yamuxConfig, authToken)
-	case "tcpmux":
-		listenTCPMux(listenAddr, currentSession, yamuxConfig, authToken)
-	default:
-		log.Fatalf("Unknown tunnel type: %s", tunnelType)
+// deleteMetrics drops a removed tunnel's series or, with an endpoint, only
+// that endpoint's, so they are not exported forever.
+func deleteMetrics(tunnel, endpoint string) {
+	for _, m := range metricFamilies {
+		switch {
+		case endpoint == "":
+			m.Delete(tunnel)
+		case len(m.labels) > 1 && m.labels[1] == "endpoint":
+			m.Delete(tunnel, endpoint)
+		}
 	}
 }
 
-func startPublicListener(publicAddr string, portIndex int, as *activeSession, ratelimit int, fragSize, fragDelay int) {
-	publicListener, err := net.Listen("tcp", publicAddr)
-	if err != nil {
-		log.Printf("[Server] FATAL: Could not listen on public port %s: %v", publicAddr, err)
+func (m *metricFamily) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.series) == 0 {
 		return
 	}
-	defer publicListener.Close()
-	log.Printf("[Server] ✅ Listening for public traffic on %s (Index: %d)", publicAddr, portIndex)
-
-	for {
-		publicConn, err := publicListener.Accept()
-		if err != nil {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		labels := formatLabels(m.labels, s.labelValues)
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labels, strconv.FormatFloat(s.value, 'g', -1, 64))
 			continue
 		}
+		leNames := append(append([]string(nil), m.labels...), "le")
+		leValues := append(append([]string(nil), s.labelValues...), "")
+		for i, le := range m.buckets {
+			leValues[len(leValues)-1] = strconv.FormatFloat(le, 'g', -1, 64)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(leNames, leValues), s.counts[i])
+		}
+		leValues[len(leValues)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(leNames, leValues), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, strconv.FormatFloat(s.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels, s.count)
+	}
+}
 
-		go func(publicConn net.Conn) {
-			defer publicConn.Close()
-			sess := as.Get()
-			if sess == nil || sess.IsClosed() {
-				return
-			}
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
 
-			stream, err := sess.OpenStream()
-			if err != nil {
-				return
-			}
-			defer stream.Close()
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, n := range names {
+		parts[i] = n + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
 
-			stats.Lock()
-			stats.ActiveConnections++
-			stats.Unlock()
-			defer func() {
-				stats.Lock()
-				stats.ActiveConnections--
-				stats.Unlock()
-			}()
+func writeMetrics(w io.Writer, tm *tunnelManager) {
+	for _, t := range tm.List() {
+		running := 0.0
+		if t.Running() {
+			running = 1
+		}
+		metricTunnelRunning.Set(running, t.Name, t.cfg.Mode, t.cfg.Transport)
+	}
+	for _, m := range metricFamilies {
+		m.write(w)
+	}
+}
 
-			stream.SetWriteDeadline(time.Now().Add(5 * time.Second))
-			_, err = stream.Write([]byte{byte(portIndex)})
-			stream.SetWriteDeadline(time.Time{})
-			if err != nil {
-				log.Printf("[Server] Failed to send port index to client: %v", err)
-				return
-			}
+// =========================================================================
+//                             CONFIGURATION
+// =========================================================================
 
-			c := publicConn
-			if ratelimit > 0 {
-				c = &rateLimitedConn{Conn: publicConn, rate: ratelimit}
-			}
+// Config describes one tunnel. It is read from a YAML file with --config,
+// or assembled from the flags the interactive menu passes to --mode.
+type Config struct {
+	Name      string `yaml:"name" json:"name"`
+	Mode      string `yaml:"mode" json:"mode"`
+	Transport string `yaml:"transport" json:"transport"`
+	Token     string `yaml:"token" json:"token"`
 
-			go pipeCount(stream, c, &stats.TotalBytesIn, fragSize, fragDelay)
-			pipeCount(c, stream, &stats.TotalBytesOut, 0, 0)
-		}(publicConn)
+	// Server side.
+	Listen      string   `yaml:"listen" json:"listen"`
+	Path        string   `yaml:"path" json:"path"`
+	CertFile    string   `yaml:"cert_file" json:"cert_file"`
+	KeyFile     string   `yaml:"key_file" json:"key_file"`
+	PublicPorts []string `yaml:"public_ports" json:"public_ports"`
+	Balance     string   `yaml:"balance" json:"balance"`
+	// ClientCA makes the server require a client certificate signed by
+	// this CA on TLS transports.
+	ClientCA string `yaml:"client_ca" json:"client_ca"`
+	// DynamicPorts lets clients open public ports over the control stream.
+	DynamicPorts DynamicPortsConfig `yaml:"dynamic_ports" json:"dynamic_ports"`
+	// Proxy exposes a SOCKS5 and HTTP CONNECT proxy whose connections exit
+	// through a client.
+	Proxy ProxyConfig `yaml:"proxy" json:"proxy"`
+	// AcceptProxyProtocol makes public ports require a PROXY v1 or v2
+	// header, for servers behind a load balancer that sends one.
+	AcceptProxyProtocol bool `yaml:"accept_proxy_protocol" json:"accept_proxy_protocol"`
+
+	// Client side.
+	Server       string   `yaml:"server" json:"server"`
+	LocalTargets []string `yaml:"local_targets" json:"local_targets"`
+	// Servers are further endpoints to fail over to, tried by ascending
+	// priority after Server.
+	Servers   []ServerEndpoint `yaml:"servers" json:"servers"`
+	Reconnect ReconnectConfig  `yaml:"reconnect" json:"reconnect"`
+	// Forwards are local ports whose connections the server carries on to
+	// a destination on its side.
+	Forwards []ForwardConfig `yaml:"forwards" json:"forwards"`
+	// RemotePorts asks the server to open public ports for named local
+	// targets, as "name=port" or "name=low-high" for any free port in a range.
+	RemotePorts []string `yaml:"remote_ports" json:"remote_ports"`
+	// ProxyProtocol prepends a PROXY header ("v1" or "v2") to connections
+	// to a local target, keyed by service name or target address.
+	ProxyProtocol map[string]string `yaml:"proxy_protocol" json:"proxy_protocol"`
+
+	// UDPIdleTimeoutMs is how long a UDP peer may stay silent before its
+	// stream is closed, on both sides.
+	UDPIdleTimeoutMs int `yaml:"udp_idle_timeout_ms" json:"udp_idle_timeout_ms"`
+	// MaxUDPPeers caps how many peers each public UDP port relays at once.
+	// Datagrams from further peers are dropped until one goes idle.
+	MaxUDPPeers int `yaml:"max_udp_peers" json:"max_udp_peers"`
+	// How the client checks the wss/quic server certificate. With none of
+	// these set the certificate is accepted without verification.
+	PinSHA256  string `yaml:"pin_sha256" json:"pin_sha256"`
+	CAFile     string `yaml:"ca_file" json:"ca_file"`
+	VerifyTLS  bool   `yaml:"verify_tls" json:"verify_tls"`
+	ServerName string `yaml:"server_name" json:"server_name"`
+	ClientCert string `yaml:"client_cert" json:"client_cert"`
+	ClientKey  string `yaml:"client_key" json:"client_key"`
+
+	// AllowDestinations lists where the peer may have this side dial: on
+	// a server for forward-mode clients, on a client for proxy exits.
+	// Nothing is dialled while it is empty.
+	AllowDestinations []string `yaml:"allow_destinations" json:"allow_destinations"`
+
+	Fragment    FragmentConfig `yaml:"fragment" json:"fragment"`
+	// RateLimitKB caps each connection in both directions. It is kept for
+	// older configs; rate_limits.connection takes precedence.
+	RateLimitKB int        `yaml:"rate_limit_kb" json:"rate_limit_kb"`
+	RateLimits  RateLimits `yaml:"rate_limits" json:"rate_limits"`
+	// RateLimitBytes is the --ratelimit flag's per-connection limit, in
+	// bytes per second so limits under 1 KB/s still hold. rate_limit_kb
+	// replaces it once set.
+	RateLimitBytes int `yaml:"-" json:"-"`
+	// Quotas cap the traffic of the whole tunnel or of single ports over a
+	// period.
+	Quotas []QuotaConfig `yaml:"quotas" json:"quotas"`
+	// Access limits who may connect to a server's public ports.
+	Access []AccessConfig `yaml:"access" json:"access"`
+	// AuthBans bans IPs that keep failing the tunnel handshake.
+	AuthBans AuthBansConfig `yaml:"auth_bans" json:"auth_bans"`
+}
+
+// fileConfig is the layout of a --config file: either a single tunnel at the
+// top level, or a list of named tunnels. The dashboard and log file are
+// shared by every tunnel in the process.
+type fileConfig struct {
+	Config    `yaml:",inline"`
+	LogFile   string          `yaml:"log_file"`
+	Dashboard DashboardConfig `yaml:"dashboard"`
+	Tunnels   []*Config       `yaml:"tunnels"`
+	// GlobalRateLimit is shared by every tunnel in the process.
+	GlobalRateLimit BandwidthLimit `yaml:"global_rate_limit"`
+}
+
+// ServerEndpoint is one server a client can connect to. Transport,
+// PinSHA256 and ServerName default to the tunnel's, so a backup with a
+// certificate of its own can be pinned separately.
+type ServerEndpoint struct {
+	Address    string `yaml:"address" json:"address"`
+	Transport  string `yaml:"transport" json:"transport"`
+	Priority   int    `yaml:"priority" json:"priority"`
+	PinSHA256  string `yaml:"pin_sha256" json:"pin_sha256"`
+	ServerName string `yaml:"server_name" json:"server_name"`
+}
+
+type ReconnectConfig struct {
+	MinDelayMs int `yaml:"min_delay_ms" json:"min_delay_ms"`
+	MaxDelayMs int `yaml:"max_delay_ms" json:"max_delay_ms"`
+	// FailbackIntervalMs is how often a client on a fallback endpoint
+	// checks whether a preferred one is back.
+	FailbackIntervalMs int `yaml:"failback_interval_ms" json:"failback_interval_ms"`
+}
+
+// ProxyConfig is a server's SOCKS5 and HTTP CONNECT listener. Users are
+// required unless it listens on loopback.
+type ProxyConfig struct {
+	Listen string          `yaml:"listen" json:"listen"`
+	Users  []DashboardUser `yaml:"users" json:"users"`
+}
+
+type ForwardConfig struct {
+	Listen      string `yaml:"listen" json:"listen"`
+	Destination string `yaml:"destination" json:"destination"`
+}
+
+// DynamicPortsConfig is the policy for ports clients ask for. All clients of
+// a server tunnel share its token, so the limits apply per token.
+type DynamicPortsConfig struct {
+	// Allow lists the ports clients may claim, as "port" or "low-high".
+	// Requests are refused while it is empty.
+	Allow []string `yaml:"allow" json:"allow"`
+	// MaxPorts caps how many ports may be claimed at once; 0 is no cap.
+	MaxPorts int `yaml:"max_ports" json:"max_ports"`
+}
+
+func (d *DynamicPortsConfig) allows(port int) bool {
+	for _, r := range d.Allow {
+		if lo, hi, err := parsePortRange(r); err == nil && port >= lo && port <= hi {
+			return true
+		}
 	}
+	return false
 }
 
-// MODIFIED: This function now creates a robust, optimized http.Server for WSS.
-func listenWSS(listenAddr, path, certFile, keyFile string, as *activeSession, config *yamux.Config, authToken string) {
-	mux := http.NewServeMux()
-	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
-		if authToken != "" && r.Header.Get("X-Auth-Token") != authToken {
-			log.Printf("[Server] WSS Auth failed for %s. Invalid token.", r.RemoteAddr)
-			http.Error(w, "Forbidden", http.StatusForbidden)
-			return
+// parsePortRange parses "8080" or "20000-20100".
+func parsePortRange(s string) (lo, hi int, err error) {
+	first, last, isRange := strings.Cut(s, "-")
+	if !isRange {
+		last = first
+	}
+	lo, err1 := strconv.Atoi(first)
+	hi, err2 := strconv.Atoi(last)
+	if err1 != nil || err2 != nil || lo < 1 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("invalid port or range %q", s)
+	}
+	return lo, hi, nil
+}
+
+// BandwidthLimit is a token bucket setting. Zero rates are unlimited and a
+// zero burst allows one second's worth of traffic at once.
+type BandwidthLimit struct {
+	InKB    int `yaml:"in_kb" json:"in_kb"`
+	OutKB   int `yaml:"out_kb" json:"out_kb"`
+	BurstKB int `yaml:"burst_kb" json:"burst_kb"`
+	// bytes, when set, is the rate in both directions in bytes per second
+	// instead of InKB and OutKB.
+	bytes int
+}
+
+// rates returns the in and out rates in bytes per second.
+func (l BandwidthLimit) rates() (in, out int) {
+	if l.bytes > 0 {
+		return l.bytes, l.bytes
+	}
+	return l.InKB * 1024, l.OutKB * 1024
+}
+
+func (l BandwidthLimit) burst(rate int) int {
+	if l.BurstKB > 0 {
+		return l.BurstKB * 1024
+	}
+	return rate
+}
+
+func (l BandwidthLimit) String() string {
+	if l.bytes > 0 {
+		return fmt.Sprintf("%d B/s each way", l.bytes)
+	}
+	rate := func(kb int) string {
+		if kb == 0 {
+			return "unlimited"
 		}
-		wsConn, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: []string{"tunnel"}})
-		if err != nil {
-			log.Printf("[Server] Websocket accept failed: %v", err)
-			return
+		return fmt.Sprintf("%d KB/s", kb)
+	}
+	s := "in " + rate(l.InKB) + ", out " + rate(l.OutKB)
+	if l.BurstKB > 0 {
+		s += fmt.Sprintf(", burst %d KB", l.BurstKB)
+	}
+	return s
+}
+
+func (l BandwidthLimit) validate() error {
+	if l.InKB < 0 || l.OutKB < 0 || l.BurstKB < 0 {
+		return errors.New("in_kb, out_kb and burst_kb must not be negative")
+	}
+	return nil
+}
+
+// RateLimits are a tunnel's bandwidth limits by scope. Each port and each
+// remote IP gets buckets of its own, shared by all its connections.
+type RateLimits struct {
+	Tunnel     BandwidthLimit `yaml:"tunnel" json:"tunnel"`
+	Port       BandwidthLimit `yaml:"port" json:"port"`
+	RemoteIP   BandwidthLimit `yaml:"remote_ip" json:"remote_ip"`
+	Connection BandwidthLimit `yaml:"connection" json:"connection"`
+}
+
+func (rl RateLimits) validate() error {
+	var problems []string
+	for name, l := range map[string]BandwidthLimit{"tunnel": rl.Tunnel, "port": rl.Port, "remote_ip": rl.RemoteIP, "connection": rl.Connection} {
+		if err := l.validate(); err != nil {
+			problems = append(problems, name+": "+err.Error())
 		}
-		conn := websocket.NetConn(context.Background(), wsConn, websocket.MessageBinary)
-		go handleNewClient(conn, as, config)
-	})
+	}
+	sort.Strings(problems)
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
 
-	// Create a robust server with timeouts to prevent resource exhaustion from scanners.
-	server := &http.Server{
-		Addr:         listenAddr,
-		Handler:      mux,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  90 * time.Second, // Crucial for cleaning up stalled connections.
+// connectionLimit is rate_limits.connection, or rate_limit_kb (or the
+// --ratelimit flag) in both directions when that is not set.
+func (c *Config) connectionLimit() BandwidthLimit {
+	if c.RateLimits.Connection != (BandwidthLimit{}) {
+		return c.RateLimits.Connection
 	}
+	if c.RateLimitKB == 0 && c.RateLimitBytes > 0 {
+		return BandwidthLimit{bytes: c.RateLimitBytes}
+	}
+	return BandwidthLimit{InKB: c.RateLimitKB, OutKB: c.RateLimitKB}
+}
+
+// QuotaConfig caps the traffic of a tunnel, or of one of its ports, over a
+// period.
+type QuotaConfig struct {
+	// Port is a public port or service on a server, a local target or
+	// service on a client; empty for the whole tunnel.
+	Port    string `yaml:"port" json:"port"`
+	LimitMB int64  `yaml:"limit_mb" json:"limit_mb"`
+	// Count is the traffic that counts towards the limit: both, in or out.
+	Count string `yaml:"count" json:"count"`
+	// Reset is never, daily, monthly (on ResetDay) or a YYYY-MM-DD date
+	// on which usage starts over once.
+	Reset    string `yaml:"reset" json:"reset"`
+	ResetDay int    `yaml:"reset_day" json:"reset_day"`
+	// WarnPercent are the usage levels logged on the way up.
+	WarnPercent []int `yaml:"warn_percent" json:"warn_percent"`
+	// Action is what happens once the limit is reached: refuse new
+	// connections, or throttle every connection to ThrottleKB.
+	Action     string `yaml:"action" json:"action"`
+	ThrottleKB int    `yaml:"throttle_kb" json:"throttle_kb"`
+}
+
+func (q *QuotaConfig) limit() int64 {
+	return q.LimitMB * 1024 * 1024
+}
 
-	log.Printf("[Server] ✅ Listening for WSS tunnel on %s", listenAddr)
-	if err := server.ListenAndServeTLS(certFile, keyFile); err != nil {
-		log.Fatalf("[Server] HTTPS server failed: %v", err)
+// periodStart returns when the period containing now began, or the zero
+// time for usage that has never been reset.
+func (q *QuotaConfig) periodStart(now time.Time) time.Time {
+	y, m, d := now.Date()
+	switch q.Reset {
+	case "never":
+		return time.Time{}
+	case "daily":
+		return time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	case "monthly":
+		start := time.Date(y, m, q.ResetDay, 0, 0, 0, 0, now.Location())
+		if now.Before(start) {
+			start = start.AddDate(0, -1, 0)
+		}
+		return start
+	}
+	date, err := time.ParseInLocation(time.DateOnly, q.Reset, now.Location())
+	if err != nil || now.Before(date) {
+		return time.Time{}
 	}
+	return date
 }
 
-func listenTCPMux(listenAddr string, as *activeSession, config *yamux.Config, authToken string) {
-	listener, err := net.Listen("tcp", listenAddr)
-	if err != nil {
-		log.Fatalf("[Server] Raw TCP listener failed on %s: %v", listenAddr, err)
+// nextReset returns when usage next starts over, or the zero time if it
+// never does.
+func (q *QuotaConfig) nextReset(now time.Time) time.Time {
+	switch q.Reset {
+	case "never":
+		return time.Time{}
+	case "daily":
+		return q.periodStart(now).AddDate(0, 0, 1)
+	case "monthly":
+		return q.periodStart(now).AddDate(0, 1, 0)
 	}
-	defer listener.Close()
-	log.Printf("[Server] ✅ Listening for raw TCP Mux tunnel on %s", listenAddr)
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("[Server] Raw TCP accept error: %v", err)
-			continue
+	date, err := time.ParseInLocation(time.DateOnly, q.Reset, now.Location())
+	if err != nil || !now.Before(date) {
+		return time.Time{}
+	}
+	return date
+}
+
+func (q *QuotaConfig) validate() error {
+	var problems []string
+	addf := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	if q.LimitMB <= 0 {
+		addf("limit_mb: must be positive")
+	}
+	switch q.Count {
+	case "both", "in", "out":
+	default:
+		addf("count: unknown value %q (want both, in or out)", q.Count)
+	}
+	switch q.Reset {
+	case "never", "daily", "monthly":
+	default:
+		if _, err := time.Parse(time.DateOnly, q.Reset); err != nil {
+			addf("reset: unknown value %q (want never, daily, monthly or a YYYY-MM-DD date)", q.Reset)
 		}
-		go func(c net.Conn) {
-			if authToken != "" {
-				c.SetReadDeadline(time.Now().Add(10 * time.Second))
-				token, err := bufio.NewReader(c).ReadString('\n')
-				c.SetReadDeadline(time.Time{})
-				if err != nil {
-					log.Printf("[Server] Failed to read token from %s: %v", c.RemoteAddr(), err)
-					c.Close()
-					return
-				}
-				if strings.TrimSpace(token) != authToken {
-					log.Printf("[Server] Auth failed for %s. Invalid token.", c.RemoteAddr())
-					c.Close()
-					return
-				}
-			}
-			handleNewClient(c, as, config)
-		}(conn)
 	}
+	if q.ResetDay < 1 || q.ResetDay > 28 {
+		addf("reset_day: must be between 1 and 28")
+	}
+	for _, w := range q.WarnPercent {
+		if w < 1 || w > 99 {
+			addf("warn_percent: %d is not between 1 and 99", w)
+		}
+	}
+	switch q.Action {
+	case "refuse":
+	case "throttle":
+		if q.ThrottleKB <= 0 {
+			addf("throttle_kb: must be positive with action throttle")
+		}
+	default:
+		addf("action: unknown value %q (want refuse or throttle)", q.Action)
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
 }
 
-func handleNewClient(conn net.Conn, as *activeSession, config *yamux.Config) {
-	log.Printf("[Server] 🤝 Authenticated client connected from %s", conn.RemoteAddr())
-	session, err := yamux.Server(conn, config)
-	if err != nil {
-		log.Printf("[Server] Yamux server creation failed for %s: %v", conn.RemoteAddr(), err)
-		return
+// AccessConfig are the access rules of a public port, or of every port
+// without rules of its own when Port is empty.
+type AccessConfig struct {
+	Port string `yaml:"port" json:"port"`
+	// Allow admits only these IPs and CIDR ranges when it is not empty;
+	// Deny refuses its entries either way.
+	Allow []string `yaml:"allow" json:"allow"`
+	Deny  []string `yaml:"deny" json:"deny"`
+	// Limits on connections open at once and on new connections per
+	// second; 0 is no limit.
+	MaxConnections      int `yaml:"max_connections" json:"max_connections"`
+	MaxConnectionsPerIP int `yaml:"max_connections_per_ip" json:"max_connections_per_ip"`
+	NewConnectionsPerIP int `yaml:"new_connections_per_ip" json:"new_connections_per_ip"`
+}
+
+func (a *AccessConfig) validate() error {
+	var problems []string
+	if _, err := parsePrefixes(a.Allow); err != nil {
+		problems = append(problems, "allow: "+err.Error())
 	}
-	as.Set(session)
-	log.Println("[Server] ✅ Client session is now active.")
-	stats.Lock()
-	stats.Connected = true
-	stats.Unlock()
-	<-session.CloseChan()
-	log.Printf("[Server] 🔌 Client session from %s has closed.", conn.RemoteAddr())
-	stats.Lock()
-	stats.Connected = false
-	stats.Unlock()
+	if _, err := parsePrefixes(a.Deny); err != nil {
+		problems = append(problems, "deny: "+err.Error())
+	}
+	if a.MaxConnections < 0 || a.MaxConnectionsPerIP < 0 || a.NewConnectionsPerIP < 0 {
+		problems = append(problems, "max_connections, max_connections_per_ip and new_connections_per_ip must not be negative")
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
 }
 
-// =========================================================================
-//                             CLIENT LOGIC
-// =========================================================================
+// AuthBansConfig is when a server bans IPs that fail the tunnel handshake.
+type AuthBansConfig struct {
+	Disabled bool `yaml:"disabled" json:"disabled"`
+	// MaxFailures within WindowMs ban an IP for BanMs. Each further ban
+	// doubles, up to MaxBanMs.
+	MaxFailures int `yaml:"max_failures" json:"max_failures"`
+	WindowMs    int `yaml:"window_ms" json:"window_ms"`
+	BanMs       int `yaml:"ban_ms" json:"ban_ms"`
+	MaxBanMs    int `yaml:"max_ban_ms" json:"max_ban_ms"`
+	// Ignore lists IPs and CIDR ranges that are never banned. It defaults
+	// to loopback.
+	Ignore []string `yaml:"ignore" json:"ignore"`
+	// TrustedProxies lists the CDN or reverse proxies in front of a wss
+	// listener. Without it, every client behind one shares the proxy's IP,
+	// and a ban locks them all out. Connections from these take the client
+	// IP from ClientIPHeader (default X-Forwarded-For) instead.
+	TrustedProxies []string `yaml:"trusted_proxies" json:"trusted_proxies"`
+	ClientIPHeader string   `yaml:"client_ip_header" json:"client_ip_header"`
+}
+
+type FragmentConfig struct {
+	Size    int `yaml:"size" json:"size"`
+	DelayMs int `yaml:"delay_ms" json:"delay_ms"`
+}
+
+type DashboardConfig struct {
+	Disabled bool   `yaml:"disabled" json:"disabled"`
+	Listen   string `yaml:"listen" json:"listen"`
+	Port     string `yaml:"port" json:"port"`
+	// TLS serves the dashboard over HTTPS with CertFile/KeyFile, which
+	// default to the tunnel's server.crt/server.key.
+	TLS      bool            `yaml:"tls" json:"tls"`
+	CertFile string          `yaml:"cert_file" json:"cert_file"`
+	KeyFile  string          `yaml:"key_file" json:"key_file"`
+	Users    []DashboardUser `yaml:"users" json:"users"`
+}
+
+// DashboardUser is a panel login. PasswordHash is a bcrypt hash as printed
+// by --hash-password.
+type DashboardUser struct {
+	Username     string `yaml:"username" json:"username"`
+	PasswordHash string `yaml:"password_hash" json:"password_hash"`
+}
 
-func runClient(serverURL string, localAddrs string, ratelimit int, tunnelType, authToken string, fragSize, fragDelay int) {
-	localAddrList := strings.Split(localAddrs, ",")
-	if len(localAddrList) == 0 || localAddrList[0] == "" {
-		log.Fatal("[Client] No local addresses provided to forward to. Exiting.")
+func loadConfig(path string) (*fileConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
 	}
-	log.Printf("[Client] Forwarding to %d local addresses: %v", len(localAddrList), localAddrList)
+	defer f.Close()
 
-	yamuxConfig := yamux.DefaultConfig()
-	yamuxConfig.KeepAliveInterval = 30 * time.Second
-	yamuxConfig.ConnectionWriteTimeout = 30 * time.Second
-	yamuxConfig.MaxStreamWindowSize = 2 * 1024 * 1024
+	fc := &fileConfig{}
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(fc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := fc.prepare(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return fc, nil
+}
 
-	for {
-		log.Printf("[Client] ... Attempting connection to %s using %s", serverURL, tunnelType)
-		stats.Lock()
-		stats.Connected = false
-		stats.Unlock()
+// prepare folds the single-tunnel form into Tunnels, fills in defaults and
+// validates every tunnel.
+func (fc *fileConfig) prepare() error {
+	var problems []string
+	if len(fc.Tunnels) == 0 {
+		single := fc.Config
+		if single.Name == "" {
+			single.Name = "default"
+		}
+		fc.Tunnels = []*Config{&single}
+	} else if fc.Mode != "" {
+		problems = append(problems, "use either a top-level 'mode' or a 'tunnels' list, not both")
+	}
 
-		var conn net.Conn
-		var err error
+	names := map[string]bool{}
+	ports := map[string]string{}
+	hasServer := false
+	for i, cfg := range fc.Tunnels {
+		label := fmt.Sprintf("tunnels[%d]", i)
+		if cfg.Name != "" {
+			label = fmt.Sprintf("tunnel %q", cfg.Name)
+		}
+		if !validTunnelName(cfg.Name) {
+			problems = append(problems, label+": name must be 1-64 letters, digits, '-' or '_'")
+		} else if names[cfg.Name] {
+			problems = append(problems, label+": duplicate name")
+		}
+		names[cfg.Name] = true
 
-		switch tunnelType {
-		case "wss":
-			header := http.Header{}
-			if authToken != "" {
-				header.Set("X-Auth-Token", authToken)
-			}
-			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-			wsConn, _, dialErr := websocket.Dial(ctx, serverURL, &websocket.DialOptions{
-				Subprotocols:   []string{"tunnel"},
-				HTTPClient:     &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}},
-				HTTPHeader:     header,
-			})
-			cancel()
-			if dialErr != nil {
-				err = dialErr
-			} else {
-				conn = websocket.NetConn(context.Background(), wsConn, websocket.MessageBinary)
-			}
-		case "tcpmux":
-			conn, err = net.DialTimeout("tcp", serverURL, 20*time.Second)
-			if err == nil && authToken != "" {
-				_, writeErr := conn.Write([]byte(authToken + "\n"))
-				if writeErr != nil {
-					err = writeErr
-					conn.Close()
+		cfg.applyDefaults()
+		if err := cfg.validate(); err != nil {
+			problems = append(problems, label+": "+err.Error())
+		}
+		if cfg.Mode == "server" {
+			hasServer = true
+			for _, p := range append([]string{cfg.Listen}, cfg.publicAddrs()...) {
+				port := p[strings.LastIndex(p, ":")+1:]
+				if other, ok := ports[port]; ok && port != "" {
+					problems = append(problems, fmt.Sprintf("%s: port %s is already used by tunnel %q", label, port, other))
 				}
+				ports[port] = cfg.Name
 			}
-		default:
-			log.Fatalf("Unknown client tunnel type: %s", tunnelType)
 		}
+	}
 
-		if err != nil {
-			log.Printf("[Client] ❌ Connection failed: %v. Retrying in 5s...", err)
-			time.Sleep(5 * time.Second)
-			continue
+	if fc.Dashboard.Port == "" {
+		fc.Dashboard.Port = defaultDashboardPort("client")
+		if hasServer {
+			fc.Dashboard.Port = defaultDashboardPort("server")
 		}
-
-		log.Println("[Client] ✅ Tunnel connection established!")
-		stats.Lock()
-		stats.Connected = true
-		stats.Unlock()
-		if f, err := os.Create(successSignalPath); err == nil {
-			f.Close()
+	}
+	if !validPort(fc.Dashboard.Port) {
+		problems = append(problems, fmt.Sprintf("dashboard.port: invalid port %q", fc.Dashboard.Port))
+	}
+	fc.Dashboard.applyDefaults()
+	if !fc.Dashboard.Disabled {
+		if err := fc.Dashboard.validate(); err != nil {
+			problems = append(problems, "dashboard: "+err.Error())
 		}
+	}
+	if err := fc.GlobalRateLimit.validate(); err != nil {
+		problems = append(problems, "global_rate_limit: "+err.Error())
+	}
+	if fc.LogFile == "" {
+		fc.LogFile = logFilePath
+	}
 
-		session, err := yamux.Client(conn, yamuxConfig)
-		if err != nil {
-			log.Printf("[Client] ❌ Multiplexing failed: %v", err)
-			conn.Close()
-			continue
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (dc *DashboardConfig) applyDefaults() {
+	if dc.Listen == "" {
+		dc.Listen = "127.0.0.1"
+	}
+	if dc.CertFile == "" {
+		dc.CertFile = "server.crt"
+	}
+	if dc.KeyFile == "" {
+		dc.KeyFile = "server.key"
+	}
+}
+
+func (dc *DashboardConfig) validate() error {
+	var problems []string
+	if dc.Listen != "" && net.ParseIP(dc.Listen) == nil && dc.Listen != "localhost" {
+		problems = append(problems, fmt.Sprintf("listen: %q is not an IP address", dc.Listen))
+	}
+	seen := map[string]bool{}
+	for i, u := range dc.Users {
+		if u.Username == "" {
+			problems = append(problems, fmt.Sprintf("users[%d]: username is required", i))
+		} else if seen[u.Username] {
+			problems = append(problems, fmt.Sprintf("users[%d]: duplicate username %q", i, u.Username))
 		}
+		seen[u.Username] = true
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			problems = append(problems, fmt.Sprintf("users[%d]: password_hash is not a bcrypt hash (use --hash-password)", i))
+		}
+	}
+	if len(dc.Users) == 0 {
+		problems = append(problems, "users: at least one user is required (use --hash-password)")
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
 
-		go func() {
-			<-session.CloseChan()
-			stats.Lock()
-			stats.Connected = false
-			stats.Unlock()
-		}()
+func (dc *DashboardConfig) addr() string {
+	return net.JoinHostPort(dc.Listen, dc.Port)
+}
 
-		for {
-			stream, err := session.AcceptStream()
-			if err != nil {
-				log.Printf("[Client] ... Session terminated: %v. Reconnecting...", err)
-				break
-			}
-			go func(s *yamux.Stream) {
-				defer s.Close()
-				s.SetReadDeadline(time.Now().Add(5 * time.Second))
-				idxByte := make([]byte, 1)
-				_, err := s.Read(idxByte)
-				s.SetReadDeadline(time.Time{})
-				if err != nil {
-					log.Printf("[Client] Failed to read port index from stream: %v", err)
-					return
-				}
-				portIndex := int(idxByte[0])
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
 
-				if portIndex < 0 || portIndex >= len(localAddrList) {
-					log.Printf("[Client] Received invalid port index %d. Max is %d.", portIndex, len(localAddrList)-1)
-					return
-				}
+func defaultDashboardPort(mode string) string {
+	if mode == "server" {
+		return "8080"
+	}
+	return "8081"
+}
 
-				targetAddr := localAddrList[portIndex]
-				log.Printf("[Client] New stream for index %d -> %s", portIndex, targetAddr)
-				
-				localConn, err := net.Dial("tcp", targetAddr)
-				if err != nil {
-					log.Printf("[Client] Failed to dial local service '%s': %v", targetAddr, err)
-					return
-				}
-				defer localConn.Close()
-				
-				stats.Lock()
-				stats.ActiveConnections++
-				stats.Unlock()
-				defer func() {
-					stats.Lock()
-					stats.ActiveConnections--
-					stats.Unlock()
-				}()
-
-				c := localConn
-				if ratelimit > 0 {
-					c = &rateLimitedConn{Conn: localConn, rate: ratelimit}
-				}
-				
-				go pipeCount(c, s, &stats.TotalBytesOut, 0, 0)
-				pipeCount(s, c, &stats.TotalBytesIn, fragSize, fragDelay)
-			}(stream)
+func validTunnelName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
 		}
 	}
+	return true
+}
+
+func (c *Config) applyDefaults() {
+	if c.Transport == "" {
+		c.Transport = "wss"
+	}
+	if c.Balance == "" {
+		c.Balance = balanceRoundRobin
+	}
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	if c.CertFile == "" {
+		c.CertFile = "server.crt"
+	}
+	if c.KeyFile == "" {
+		c.KeyFile = "server.key"
+	}
+	if c.Listen != "" && !strings.Contains(c.Listen, ":") {
+		c.Listen = ":" + c.Listen
+	}
+	for i := range c.Forwards {
+		// A bare port listens on loopback only.
+		if l := c.Forwards[i].Listen; l != "" && !strings.Contains(l, ":") {
+			c.Forwards[i].Listen = "127.0.0.1:" + l
+		}
+	}
+	for i := range c.Servers {
+		if c.Servers[i].Transport == "" {
+			c.Servers[i].Transport = c.Transport
+		}
+	}
+	if c.Reconnect.MinDelayMs == 0 {
+		c.Reconnect.MinDelayMs = 1000
+	}
+	if c.Reconnect.MaxDelayMs == 0 {
+		c.Reconnect.MaxDelayMs = 60000
+	}
+	if c.Reconnect.FailbackIntervalMs == 0 {
+		c.Reconnect.FailbackIntervalMs = 30000
+	}
+	if c.UDPIdleTimeoutMs == 0 {
+		c.UDPIdleTimeoutMs = 60000
+	}
+	if c.MaxUDPPeers == 0 {
+		c.MaxUDPPeers = 1024
+	}
+	if c.AuthBans.MaxFailures == 0 {
+		c.AuthBans.MaxFailures = 5
+	}
+	if c.AuthBans.WindowMs == 0 {
+		c.AuthBans.WindowMs = 600000
+	}
+	if c.AuthBans.BanMs == 0 {
+		c.AuthBans.BanMs = 900000
+	}
+	if c.AuthBans.MaxBanMs == 0 {
+		c.AuthBans.MaxBanMs = 7 * 86400000
+	}
+	if c.AuthBans.Ignore == nil {
+		c.AuthBans.Ignore = []string{"127.0.0.0/8", "::1"}
+	}
+	if c.AuthBans.ClientIPHeader == "" {
+		c.AuthBans.ClientIPHeader = "X-Forwarded-For"
+	}
+	for i := range c.Quotas {
+		q := &c.Quotas[i]
+		if q.Count == "" {
+			q.Count = "both"
+		}
+		if q.Reset == "" {
+			q.Reset = "never"
+		}
+		if q.ResetDay == 0 {
+			q.ResetDay = 1
+		}
+		if q.WarnPercent == nil {
+			q.WarnPercent = []int{80, 90}
+		}
+		if q.Action == "" {
+			q.Action = "refuse"
+		}
+	}
+}
+
+// serverEndpoints returns Server followed by Servers, ordered by priority.
+func (c *Config) serverEndpoints() []ServerEndpoint {
+	var eps []ServerEndpoint
+	if c.Server != "" {
+		eps = append(eps, ServerEndpoint{Address: c.Server, Transport: c.Transport})
+	}
+	eps = append(eps, c.Servers...)
+	sort.SliceStable(eps, func(i, j int) bool { return eps[i].Priority < eps[j].Priority })
+	return eps
+}
+
+// validate reports every problem in the config at once so a broken file can
+// be fixed in one pass.
+func (c *Config) validate() error {
+	var problems []string
+	addf := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	switch c.Transport {
+	case "wss", "tcpmux", "tcpmux+tls", "quic":
+	default:
+		addf("transport: unknown value %q (want wss, tcpmux, tcpmux+tls or quic)", c.Transport)
+	}
+	if c.Token == "" && !c.certAuth() {
+		addf("token: required unless client certificates are used on a TLS transport")
+	}
+	if c.Fragment.Size < 0 || c.Fragment.DelayMs < 0 {
+		addf("fragment: size and delay_ms must not be negative")
+	}
+	if c.RateLimitKB < 0 {
+		addf("rate_limit_kb: must not be negative")
+	}
+	if c.RateLimitBytes < 0 {
+		addf("--ratelimit: must not be negative")
+	}
+	if err := c.RateLimits.validate(); err != nil {
+		addf("rate_limits: %v", err)
+	}
+	if c.UDPIdleTimeoutMs < 0 {
+		addf("udp_idle_timeout_ms: must not be negative")
+	}
+	if c.MaxUDPPeers < 0 {
+		addf("max_udp_peers: must not be negative")
+	}
+	if _, err := parseDestRules(c.AllowDestinations); err != nil {
+		addf("allow_destinations: %v", err)
+	}
+	quotaPorts := map[string]bool{}
+	for i, q := range c.Quotas {
+		if err := q.validate(); err != nil {
+			addf("quotas[%d]: %v", i, err)
+		}
+		endpoint := c.portEndpoint(q.Port)
+		if quotaPorts[endpoint] {
+			addf("quotas[%d]: %q already has a quota", i, q.Port)
+		}
+		quotaPorts[endpoint] = true
+		if endpoint != "" && !slices.Contains(c.endpoints(), endpoint) && !c.dynamicEndpoint(endpoint) {
+			addf("quotas[%d]: %q is not a port or target of this tunnel", i, q.Port)
+		}
+	}
+
+	switch c.Mode {
+	case "server":
+		if c.Listen == "" {
+			addf("listen: required in server mode")
+		} else if _, port, err := net.SplitHostPort(c.Listen); err != nil || !validPort(port) {
+			addf("listen: invalid address %q", c.Listen)
+		}
+		if len(c.publicAddrs()) == 0 && len(c.DynamicPorts.Allow) == 0 {
+			addf("public_ports: at least one port is required in server mode (or allow some under dynamic_ports)")
+		}
+		for i, r := range c.DynamicPorts.Allow {
+			if _, _, err := parsePortRange(r); err != nil {
+				addf("dynamic_ports.allow[%d]: %v", i, err)
+			}
+		}
+		if c.DynamicPorts.MaxPorts < 0 {
+			addf("dynamic_ports.max_ports: must not be negative")
+		}
+		if b := c.AuthBans; b.MaxFailures < 0 || b.WindowMs < 0 || b.BanMs < 0 || b.MaxBanMs < b.BanMs {
+			addf("auth_bans: values must be positive and max_ban_ms at least ban_ms")
+		}
+		if _, err := parsePrefixes(c.AuthBans.Ignore); err != nil {
+			addf("auth_bans.ignore: %v", err)
+		}
+		if _, err := parsePrefixes(c.AuthBans.TrustedProxies); err != nil {
+			addf("auth_bans.trusted_proxies: %v", err)
+		} else if len(c.AuthBans.TrustedProxies) > 0 && c.Transport != "wss" {
+			addf("auth_bans.trusted_proxies: only used by the wss transport")
+		}
+		accessPorts := map[string]bool{}
+		for i, a := range c.Access {
+			if err := a.validate(); err != nil {
+				addf("access[%d]: %v", i, err)
+			}
+			endpoint := c.portEndpoint(a.Port)
+			if accessPorts[endpoint] {
+				addf("access[%d]: %q already has access rules", i, a.Port)
+			}
+			accessPorts[endpoint] = true
+			if endpoint != "" && !slices.Contains(c.endpoints(), endpoint) && !c.dynamicEndpoint(endpoint) {
+				addf("access[%d]: %q is not a public port of this tunnel", i, a.Port)
+			}
+		}
+		if c.Proxy.Listen != "" {
+			host, port, err := net.SplitHostPort(c.Proxy.Listen)
+			if err != nil || !validPort(port) {
+				addf("proxy.listen: invalid address %q", c.Proxy.Listen)
+			} else if len(c.Proxy.Users) == 0 && !isLoopback(host) {
+				addf("proxy.users: at least one user is required when listening on %s", c.Proxy.Listen)
+			}
+			for i, u := range c.Proxy.Users {
+				if u.Username == "" {
+					addf("proxy.users[%d]: username is required", i)
+				}
+				if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+					addf("proxy.users[%d]: password_hash is not a bcrypt hash (use --hash-password)", i)
+				}
+			}
+		}
+		services := map[string]bool{}
+		for i, entry := range c.PublicPorts {
+			if entry == "" {
+				// A port removed at runtime leaves its slot empty so the
+				// ports after it keep their index.
+				continue
+			}
+			name, p := splitService(entry)
+			if name != "" {
+				if !validTunnelName(name) {
+					addf("public_ports[%d]: invalid service name %q", i, name)
+				} else if services[name] {
+					addf("public_ports[%d]: service %q is bound twice", i, name)
+				}
+				services[name] = true
+			}
+			_, port := splitNetwork(p)
+			if strings.Contains(port, ":") {
+				_, port, _ = net.SplitHostPort(port)
+			}
+			if !validPort(port) {
+				addf("public_ports[%d]: invalid port %q", i, p)
+			}
+		}
+		if !validBalancePolicy(c.Balance) {
+			addf("balance: unknown policy %q (want round-robin, least-streams or random)", c.Balance)
+		}
+		if c.Transport == "wss" && !strings.HasPrefix(c.Path, "/") {
+			addf("path: must start with '/'")
+		}
+		if usesTLS(c.Transport) {
+			for _, file := range []string{c.CertFile, c.KeyFile} {
+				if _, err := os.Stat(file); err != nil {
+					addf("%s transport needs %s: %v", c.Transport, file, err)
+				}
+			}
+		}
+		if c.ClientCA != "" {
+			if !usesTLS(c.Transport) {
+				addf("client_ca: needs a TLS transport (wss, tcpmux+tls or quic)")
+			} else if _, err := os.Stat(c.ClientCA); err != nil {
+				addf("client_ca: %v", err)
+			}
+		}
+	case "client":
+		if c.Server == "" && len(c.Servers) == 0 {
+			addf("server: required in client mode (or list them under servers)")
+		}
+		for i, ep := range c.Servers {
+			if ep.Address == "" {
+				addf("servers[%d]: address is required", i)
+			}
+			switch ep.Transport {
+			case "wss", "tcpmux", "tcpmux+tls", "quic":
+			default:
+				addf("servers[%d]: unknown transport %q", i, ep.Transport)
+			}
+			if ep.PinSHA256 != "" {
+				if _, err := parseFingerprint(ep.PinSHA256); err != nil {
+					addf("servers[%d].pin_sha256: %v", i, err)
+				}
+			}
+		}
+		if c.Reconnect.MinDelayMs < 0 || c.Reconnect.MaxDelayMs < c.Reconnect.MinDelayMs || c.Reconnect.FailbackIntervalMs < 0 {
+			addf("reconnect: delays must be positive and max_delay_ms at least min_delay_ms")
+		}
+		if len(c.Access) > 0 {
+			addf("access: only server tunnels have public ports")
+		}
+		if len(c.LocalTargets) == 0 && len(c.Forwards) == 0 {
+			addf("local_targets: at least one address is required in client mode (or list forwards)")
+		}
+		for i, f := range c.Forwards {
+			if _, port, err := net.SplitHostPort(f.Listen); err != nil || !validPort(port) {
+				addf("forwards[%d]: invalid listen address %q", i, f.Listen)
+			}
+			if _, port, err := net.SplitHostPort(f.Destination); err != nil || !validPort(port) {
+				addf("forwards[%d]: invalid destination %q (want host:port)", i, f.Destination)
+			}
+		}
+		services, targets := map[string]bool{}, map[string]bool{}
+		for i, entry := range c.LocalTargets {
+			name, addr := splitService(entry)
+			targets[addr] = true
+			if _, port, err := net.SplitHostPort(addr); err != nil || !validPort(port) {
+				addf("local_targets[%d]: invalid address %q (want host:port or name=host:port)", i, addr)
+			}
+			if name != "" {
+				if !validTunnelName(name) {
+					addf("local_targets[%d]: invalid service name %q", i, name)
+				} else if services[name] {
+					addf("local_targets[%d]: service %q is listed twice", i, name)
+				}
+				services[name] = true
+			}
+		}
+		for key, v := range c.ProxyProtocol {
+			if v != "v1" && v != "v2" {
+				addf("proxy_protocol.%s: unknown version %q (want v1 or v2)", key, v)
+			}
+			if !services[key] && !targets[key] {
+				addf("proxy_protocol.%s: no local target has this name or address", key)
+			}
+		}
+		for i, entry := range c.RemotePorts {
+			name, ports := splitService(entry)
+			if !services[name] {
+				addf("remote_ports[%d]: %q does not name a local target (want name=port)", i, entry)
+			}
+			if _, _, err := parsePortRange(ports); err != nil {
+				addf("remote_ports[%d]: %v", i, err)
+			}
+		}
+		if c.PinSHA256 != "" {
+			if _, err := parseFingerprint(c.PinSHA256); err != nil {
+				addf("pin_sha256: %v", err)
+			}
+		}
+		if c.CAFile != "" {
+			if _, err := os.Stat(c.CAFile); err != nil {
+				addf("ca_file: %v", err)
+			}
+		}
+		if (c.ClientCert == "") != (c.ClientKey == "") {
+			addf("client_cert and client_key must be set together")
+		} else if c.ClientCert != "" {
+			if _, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey); err != nil {
+				addf("client_cert: %v", err)
+			}
+		}
+	default:
+		addf("mode: must be 'server' or 'client', got %q", c.Mode)
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// publicAddrs returns the listen address of every public port, skipping
+// empty slots.
+func (c *Config) publicAddrs() []string {
+	var addrs []string
+	for _, port := range c.PublicPorts {
+		if port != "" {
+			addrs = append(addrs, publicAddr(port))
+		}
+	}
+	return addrs
+}
+
+// splitService splits a "name=value" public port or local target. Entries
+// without a name are matched by their position in the list.
+func splitService(entry string) (name, value string) {
+	if i := strings.Index(entry, "="); i >= 0 {
+		return entry[:i], entry[i+1:]
+	}
+	return "", entry
+}
+
+// splitNetwork splits the "/udp" suffix off a public port. Ports without
+// one are TCP.
+func splitNetwork(addr string) (network, hostPort string) {
+	if hostPort, ok := strings.CutSuffix(addr, "/udp"); ok {
+		return "udp", hostPort
+	}
+	return "tcp", addr
+}
+
+// publicAddr returns the listen address of a public port entry, keeping
+// the "/udp" suffix so TCP and UDP ports on one number stay apart.
+func publicAddr(entry string) string {
+	_, port := splitService(entry)
+	if !strings.Contains(port, ":") {
+		return ":" + port
+	}
+	return port
+}
+
+// endpoints returns the names the tunnel's traffic is accounted under.
+func (c *Config) endpoints() []string {
+	var addrs []string
+	if c.Mode == "server" {
+		addrs = c.publicAddrs()
+		if c.Proxy.Listen != "" {
+			addrs = append(addrs, c.Proxy.Listen)
+		}
+	}
+	for _, entry := range c.LocalTargets {
+		_, addr := splitService(entry)
+		addrs = append(addrs, addr)
+	}
+	for _, f := range c.Forwards {
+		addrs = append(addrs, f.Listen)
+	}
+	if len(c.AllowDestinations) > 0 {
+		addrs = append(addrs, forwardEndpoint)
+	}
+	return addrs
+}
+
+// portEndpoint returns the stats endpoint a quota or access rule's port
+// stands for. On a server that is a public port, by number or service
+// name; on a client a local target, by address or service name.
+func (c *Config) portEndpoint(port string) string {
+	if port == "" || port == forwardEndpoint {
+		return port
+	}
+	if c.Mode != "server" {
+		if addr, ok := c.services()[port]; ok {
+			return addr
+		}
+		return port
+	}
+	for _, entry := range c.PublicPorts {
+		if name, _ := splitService(entry); name != "" && name == port {
+			return publicAddr(entry)
+		}
+	}
+	return publicAddr(port)
+}
+
+// dynamicEndpoint reports whether clients may open endpoint under
+// dynamic_ports.
+func (c *Config) dynamicEndpoint(endpoint string) bool {
+	if c.Mode != "server" {
+		return false
+	}
+	_, port, err := net.SplitHostPort(endpoint)
+	n, _ := strconv.Atoi(port)
+	return err == nil && c.DynamicPorts.allows(n)
+}
+
+// proxyVersion returns the PROXY protocol version to send to a local
+// target, or 0 for none. A setting for the service wins over one for the
+// address.
+func (c *Config) proxyVersion(service, addr string) int {
+	v, ok := c.ProxyProtocol[service]
+	if !ok || service == "" {
+		v = c.ProxyProtocol[addr]
+	}
+	switch v {
+	case "v1":
+		return 1
+	case "v2":
+		return 2
+	}
+	return 0
+}
+
+// features returns the optional abilities a client announces in its hello.
+func (c *Config) features() []string {
+	features := []string{"udp"}
+	if len(c.AllowDestinations) > 0 {
+		features = append(features, "proxy")
+	}
+	return features
+}
+
+// services returns the named local targets a client advertises.
+func (c *Config) services() map[string]string {
+	services := map[string]string{}
+	for _, entry := range c.LocalTargets {
+		if name, addr := splitService(entry); name != "" {
+			services[name] = addr
+		}
+	}
+	return services
+}
+
+func (c *Config) clone() *Config {
+	cp := *c
+	cp.PublicPorts = append([]string(nil), c.PublicPorts...)
+	cp.LocalTargets = append([]string(nil), c.LocalTargets...)
+	cp.Servers = append([]ServerEndpoint(nil), c.Servers...)
+	cp.RemotePorts = append([]string(nil), c.RemotePorts...)
+	cp.Forwards = append([]ForwardConfig(nil), c.Forwards...)
+	cp.AllowDestinations = append([]string(nil), c.AllowDestinations...)
+	cp.Proxy.Users = append([]DashboardUser(nil), c.Proxy.Users...)
+	cp.ProxyProtocol = maps.Clone(c.ProxyProtocol)
+	cp.DynamicPorts.Allow = append([]string(nil), c.DynamicPorts.Allow...)
+	cp.Quotas = append([]QuotaConfig(nil), c.Quotas...)
+	for i := range cp.Quotas {
+		cp.Quotas[i].WarnPercent = slices.Clone(c.Quotas[i].WarnPercent)
+	}
+	cp.AuthBans.Ignore = slices.Clone(c.AuthBans.Ignore)
+	cp.AuthBans.TrustedProxies = slices.Clone(c.AuthBans.TrustedProxies)
+	cp.Access = append([]AccessConfig(nil), c.Access...)
+	for i := range cp.Access {
+		cp.Access[i].Allow = slices.Clone(c.Access[i].Allow)
+		cp.Access[i].Deny = slices.Clone(c.Access[i].Deny)
+	}
+	return &cp
+}
+
+// certAuth reports whether client certificates authenticate the tunnel on
+// their own, so the token may be left empty: client_ca on a server, or
+// client_cert on a client whose servers all use TLS transports.
+func (c *Config) certAuth() bool {
+	if !usesTLS(c.Transport) {
+		return false
+	}
+	if c.Mode == "server" {
+		return c.ClientCA != ""
+	}
+	if c.ClientCert == "" {
+		return false
+	}
+	for _, ep := range c.Servers {
+		if !usesTLS(ep.Transport) {
+			return false
+		}
+	}
+	return true
+}
+
+func usesTLS(transport string) bool {
+	return transport == "wss" || transport == "tcpmux+tls" || transport == "quic"
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536
+}
+
+// =========================================================================
+//                             TUNNELS
+// =========================================================================
+
+// Tunnel is one named server or client running inside this process. Each
+// tunnel has its own transport, ports, token and stats, and can be started
+// and stopped without touching the others.
+type Tunnel struct {
+	Name  string
+	cfg   *Config
+	stats *TunnelStats
+	// limits can be changed while the tunnel runs.
+	limits tunnelLimiters
+	// quotas are replaced as a whole when the config changes, and state
+	// keeps their usage and the bans across restarts when it is set.
+	quotas atomic.Pointer[[]*quotaState]
+	state  *panelStore
+	// access holds the public ports' access rules by endpoint, and conns
+	// the connection counts they limit.
+	access atomic.Pointer[map[string]*accessRules]
+	conns  connTracker
+	// bans are the IPs shut out of a server's tunnel listener.
+	bans banList
+
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	done    chan struct{}
+	lastErr error
+	paused  bool
+
+	// Set while a server tunnel runs, so public ports can be opened and
+	// closed without restarting it.
+	runCtx context.Context
+	pool   *sessionPool
+	ports  map[string]context.CancelFunc
+	// readyFile, when set, is created each time a client tunnel connects
+	// so whoever started it can tell.
+	readyFile string
+	// forwardSess is the client's current server session while that
+	// server takes forwards.
+	forwardSess muxSession
+	// dynamic holds the ports clients opened over their control streams,
+	// by address.
+	dynamic map[string]*dynamicPort
+}
+
+// dynamicPort is a public port opened at a client's request. It stays open
+// while any session that asked for it is connected.
+type dynamicPort struct {
+	service  string
+	sessions int
+	cancel   context.CancelFunc
+}
+
+func newTunnel(cfg *Config, state *panelStore) *Tunnel {
+	t := &Tunnel{Name: cfg.Name, cfg: cfg, stats: &TunnelStats{Uptime: time.Now(), tunnel: cfg.Name}, state: state}
+	t.stats.onBytes = t.countQuotas
+	t.applyLimits(cfg)
+	t.setQuotas(cfg)
+	t.setAccess(cfg)
+	t.bans.configure(cfg.AuthBans)
+	if cfg.Mode == "server" {
+		t.loadBans()
+	}
+	return t
+}
+
+func (t *Tunnel) logf(format string, args ...any) {
+	log.Printf("["+t.Name+"] "+format, args...)
+}
+
+func (t *Tunnel) Start() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done != nil {
+		return fmt.Errorf("tunnel %q is already running", t.Name)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.cancel, t.done, t.lastErr = cancel, done, nil
+
+	t.stats.Lock()
+	t.stats.Uptime = time.Now()
+	t.stats.Unlock()
+
+	go func() {
+		var err error
+		if t.cfg.Mode == "server" {
+			err = t.runServer(ctx)
+		} else {
+			err = t.runClient(ctx)
+		}
+		if err != nil {
+			t.logf("❌ Tunnel stopped: %v", err)
+		}
+		cancel()
+		t.mu.Lock()
+		t.lastErr = err
+		t.cancel, t.done = nil, nil
+		t.mu.Unlock()
+		close(done)
+	}()
+	return nil
+}
+
+// Stop shuts the tunnel down and waits until its listeners and sessions
+// are closed.
+func (t *Tunnel) Stop() {
+	t.mu.Lock()
+	cancel, done := t.cancel, t.done
+	t.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+	t.logf("⏹️ Tunnel stopped.")
+}
+
+// Wait blocks until the tunnel stops on its own and returns why.
+func (t *Tunnel) Wait() error {
+	t.mu.Lock()
+	done := t.done
+	t.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastErr
+}
+
+func (t *Tunnel) Running() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.done != nil
+}
+
+func (t *Tunnel) LastError() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastErr
+}
+
+// Config returns a copy of the tunnel's current config.
+func (t *Tunnel) Config() *Config {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cfg.clone()
+}
+
+// Pause stops the tunnel but keeps it in the manager until Resume.
+func (t *Tunnel) Pause() {
+	t.Stop()
+	t.mu.Lock()
+	t.paused = true
+	t.mu.Unlock()
+}
+
+func (t *Tunnel) Resume() error {
+	if err := t.Start(); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.paused = false
+	t.mu.Unlock()
+	return nil
+}
+
+// SetRateLimit changes the per-connection limit of rate_limit_kb.
+func (t *Tunnel) SetRateLimit(kb int) {
+	t.mu.Lock()
+	t.cfg.RateLimitKB, t.cfg.RateLimitBytes = kb, 0
+	t.applyLimits(t.cfg)
+	t.mu.Unlock()
+	t.logf("Rate limit set to %d KB/s", kb)
+}
+
+// SetRateLimits replaces the tunnel's bandwidth limits. Open connections
+// pick them up on their next read or write.
+func (t *Tunnel) SetRateLimits(rl RateLimits) {
+	t.mu.Lock()
+	t.cfg.RateLimits = rl
+	t.applyLimits(t.cfg)
+	t.mu.Unlock()
+	t.logf("Rate limits changed: tunnel (%v), port (%v), remote IP (%v), connection (%v)", rl.Tunnel, rl.Port, rl.RemoteIP, rl.Connection)
+}
+
+// SetQuotas replaces the tunnel's quotas. Quotas on ports that already had
+// one keep their usage.
+func (t *Tunnel) SetQuotas(quotas []QuotaConfig) {
+	t.mu.Lock()
+	t.cfg.Quotas = quotas
+	cfg := t.cfg.clone()
+	t.mu.Unlock()
+	t.setQuotas(cfg)
+	t.logf("Quotas changed: %d set", len(quotas))
+}
+
+func (t *Tunnel) applyLimits(cfg *Config) {
+	t.limits.tunnel.set(cfg.RateLimits.Tunnel)
+	t.limits.port.set(cfg.RateLimits.Port)
+	t.limits.remoteIP.set(cfg.RateLimits.RemoteIP)
+	t.limits.conn.set(cfg.connectionLimit())
+}
+
+// AddPort opens a new public port on a server tunnel. A "name=port" entry
+// is routed to the client target of that name; otherwise it takes the next
+// index, so the client needs a local target at the same position.
+func (t *Tunnel) AddPort(port string) error {
+	t.mu.Lock()
+	index := len(t.cfg.PublicPorts)
+	t.mu.Unlock()
+	return t.addPortAt(port, index)
+}
+
+func (t *Tunnel) addPortAt(port string, index int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cfg.Mode != "server" {
+		return errors.New("only server tunnels have public ports")
+	}
+	addr := publicAddr(port)
+	service, _ := splitService(port)
+	for _, p := range t.cfg.PublicPorts {
+		if p != "" && publicAddr(p) == addr {
+			return fmt.Errorf("port %s is already open", port)
+		}
+		if name, _ := splitService(p); service != "" && name == service {
+			return fmt.Errorf("service %q is already bound to port %s", service, publicAddr(p))
+		}
+	}
+	if index < len(t.cfg.PublicPorts) && t.cfg.PublicPorts[index] != "" {
+		return fmt.Errorf("index %d is already used by port %s", index, t.cfg.PublicPorts[index])
+	}
+	if t.pool != nil {
+		if err := t.openPortLocked(port, index); err != nil {
+			return err
+		}
+	}
+	for len(t.cfg.PublicPorts) <= index {
+		t.cfg.PublicPorts = append(t.cfg.PublicPorts, "")
+	}
+	t.cfg.PublicPorts[index] = port
+	t.stats.registerEndpoints([]string{addr})
+	return nil
+}
+
+// RemovePort closes a public port. Streams already accepted on it run
+// until they finish, and the other ports keep their index.
+func (t *Tunnel) RemovePort(port string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	addr := publicAddr(port)
+	index := -1
+	for i, p := range t.cfg.PublicPorts {
+		if p != "" && publicAddr(p) == addr {
+			index = i
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("port %s is not open", port)
+	}
+	if len(t.cfg.publicAddrs()) == 1 && len(t.cfg.DynamicPorts.Allow) == 0 {
+		return errors.New("a server tunnel needs at least one public port")
+	}
+	if cancel := t.ports[addr]; cancel != nil {
+		cancel()
+		delete(t.ports, addr)
+	}
+	t.cfg.PublicPorts[index] = ""
+	for len(t.cfg.PublicPorts) > 0 && t.cfg.PublicPorts[len(t.cfg.PublicPorts)-1] == "" {
+		t.cfg.PublicPorts = t.cfg.PublicPorts[:len(t.cfg.PublicPorts)-1]
+	}
+	t.stats.removeEndpoint(addr)
+	t.logf("[Server] Closed public port %s", addr)
+	return nil
+}
+
+// openPortLocked starts a public listener for a running server tunnel. The
+// caller must hold t.mu.
+func (t *Tunnel) openPortLocked(entry string, index int) error {
+	service, _ := splitService(entry)
+	addr := publicAddr(entry)
+	if network, laddr := splitNetwork(addr); network == "udp" {
+		pc, err := net.ListenPacket("udp", laddr)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(t.runCtx)
+		t.ports[addr] = cancel
+		go t.startUDPListener(ctx, pc, addr, index, service, t.pool)
+		return nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(t.runCtx)
+	t.ports[addr] = cancel
+	go t.startPublicListener(ctx, ln, addr, index, service, t.pool)
+	return nil
+}
+
+// Reconfigure applies a new config. Changes to the public ports, rate
+// limits, quotas, access rules and ban settings are made in place;
+// anything else restarts this tunnel only. When a port cannot be changed,
+// nothing is.
+func (t *Tunnel) Reconfigure(cfg *Config) error {
+	old := t.Config()
+	added, removed, live := portChanges(old, cfg)
+	if live {
+		if err := t.changePorts(old, added, removed); err != nil {
+			return err
+		}
+	}
+	if cfg.RateLimitKB != old.RateLimitKB {
+		t.SetRateLimit(cfg.RateLimitKB)
+	}
+	if cfg.RateLimits != old.RateLimits {
+		t.SetRateLimits(cfg.RateLimits)
+	}
+	if !reflect.DeepEqual(cfg.Quotas, old.Quotas) {
+		t.SetQuotas(cfg.Quotas)
+	}
+	if !reflect.DeepEqual(cfg.Access, old.Access) {
+		t.SetAccess(cfg.Access)
+	}
+	if !reflect.DeepEqual(cfg.AuthBans, old.AuthBans) {
+		t.SetAuthBans(cfg.AuthBans)
+	}
+	if live {
+		return nil
+	}
+
+	wasRunning := t.Running()
+	t.Stop()
+	t.mu.Lock()
+	t.cfg = cfg
+	t.applyLimits(cfg)
+	t.mu.Unlock()
+	t.setQuotas(cfg)
+	t.setAccess(cfg)
+	t.bans.configure(cfg.AuthBans)
+	t.stats.keepEndpoints(cfg.endpoints())
+	t.logf("Config changed, restarting.")
+	if wasRunning {
+		return t.Start()
+	}
+	return nil
+}
+
+// changePorts closes the removed ports and opens the added ones. If one of
+// them fails, the ports already changed are put back as they were in old.
+func (t *Tunnel) changePorts(old *Config, added map[int]string, removed []string) error {
+	var closed, opened []string
+	undo := func() {
+		// A new port may reuse a removed one's address, and the last
+		// port cannot be closed, so close what can be closed first and
+		// the rest once the old ports are back.
+		var stuck []string
+		for _, port := range opened {
+			if t.RemovePort(port) != nil {
+				stuck = append(stuck, port)
+			}
+		}
+		for _, port := range closed {
+			if err := t.addPortAt(port, slices.Index(old.PublicPorts, port)); err != nil {
+				t.logf("[Server] ⚠️ Could not reopen public port %s: %v", publicAddr(port), err)
+			}
+		}
+		for _, port := range stuck {
+			if err := t.RemovePort(port); err != nil {
+				t.logf("[Server] ⚠️ Could not close public port %s again: %v", publicAddr(port), err)
+			}
+		}
+	}
+	for _, port := range removed {
+		if err := t.RemovePort(port); err != nil {
+			undo()
+			return err
+		}
+		closed = append(closed, port)
+	}
+	for index, port := range added {
+		if err := t.addPortAt(port, index); err != nil {
+			undo()
+			return err
+		}
+		opened = append(opened, port)
+	}
+	return nil
+}
+
+// portChanges reports whether old and cfg differ only in the rate limits,
+// quotas, access rules, ban settings and in public ports that can be
+// opened or closed live: ports removed from their slot, or new ports in
+// slots that were empty. added maps each new port's index to the port.
+func portChanges(old, cfg *Config) (added map[int]string, removed []string, ok bool) {
+	a, b := old.clone(), cfg.clone()
+	a.PublicPorts, b.PublicPorts = nil, nil
+	a.RateLimitKB, b.RateLimitKB = 0, 0
+	a.RateLimits, b.RateLimits = RateLimits{}, RateLimits{}
+	a.Quotas, b.Quotas = nil, nil
+	a.Access, b.Access = nil, nil
+	a.AuthBans, b.AuthBans = AuthBansConfig{}, AuthBansConfig{}
+	if !reflect.DeepEqual(a, b) {
+		return nil, nil, false
+	}
+	added = map[int]string{}
+	for i := 0; i < max(len(old.PublicPorts), len(cfg.PublicPorts)); i++ {
+		var before, after string
+		if i < len(old.PublicPorts) {
+			before = old.PublicPorts[i]
+		}
+		if i < len(cfg.PublicPorts) {
+			after = cfg.PublicPorts[i]
+		}
+		switch {
+		case before == after:
+		case after == "":
+			removed = append(removed, before)
+		case before == "":
+			added[i] = after
+		default:
+			return nil, nil, false
+		}
+	}
+	return added, removed, true
+}
+
+// tunnelManager holds every tunnel hosted by the process, in config order.
+type tunnelManager struct {
+	sync.RWMutex
+	tunnels []*Tunnel
+	// store is set in panel mode so API changes survive a restart.
+	store *panelStore
+	// state keeps quota usage and bans. It is the panel's store in panel
+	// mode, and state.db in --data-dir for config files that need it.
+	state *panelStore
+}
+
+func newTunnelManager() *tunnelManager {
+	return &tunnelManager{}
+}
+
+func (tm *tunnelManager) Add(cfg *Config) (*Tunnel, error) {
+	tm.Lock()
+	defer tm.Unlock()
+	for _, t := range tm.tunnels {
+		if t.Name == cfg.Name {
+			return nil, fmt.Errorf("tunnel %q already exists", cfg.Name)
+		}
+	}
+	t := newTunnel(cfg, tm.state)
+	tm.tunnels = append(tm.tunnels, t)
+	return t, nil
+}
+
+func (tm *tunnelManager) Get(name string) *Tunnel {
+	tm.RLock()
+	defer tm.RUnlock()
+	for _, t := range tm.tunnels {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+func (tm *tunnelManager) List() []*Tunnel {
+	tm.RLock()
+	defer tm.RUnlock()
+	return append([]*Tunnel(nil), tm.tunnels...)
+}
+
+// Remove stops a tunnel and forgets it.
+func (tm *tunnelManager) Remove(name string) error {
+	t := tm.Get(name)
+	if t == nil {
+		return fmt.Errorf("tunnel %q not found", name)
+	}
+	t.Stop()
+	tm.Lock()
+	tm.tunnels = slices.DeleteFunc(tm.tunnels, func(other *Tunnel) bool { return other == t })
+	tm.Unlock()
+	deleteMetrics(name, "")
+	if tm.store != nil {
+		return tm.store.DeleteTunnel(name)
+	}
+	return nil
+}
+
+// save persists a tunnel's config and paused state in panel mode.
+func (tm *tunnelManager) save(t *Tunnel) {
+	if tm.store == nil {
+		return
+	}
+	if err := tm.store.SaveTunnel(t.Config(), t.Status().Paused); err != nil {
+		log.Printf("[Panel] Failed to save tunnel %q: %v", t.Name, err)
+	}
+}
+
+// checkPorts reports a port of cfg that another server tunnel already uses.
+func (tm *tunnelManager) checkPorts(cfg *Config) error {
+	if cfg.Mode != "server" {
+		return nil
+	}
+	used := map[string]string{}
+	for _, t := range tm.List() {
+		other := t.Config()
+		if t.Name == cfg.Name || other.Mode != "server" {
+			continue
+		}
+		for _, addr := range append([]string{other.Listen}, other.publicAddrs()...) {
+			used[addr[strings.LastIndex(addr, ":")+1:]] = t.Name
+		}
+	}
+	for _, addr := range append([]string{cfg.Listen}, cfg.publicAddrs()...) {
+		port := addr[strings.LastIndex(addr, ":")+1:]
+		if owner, ok := used[port]; ok {
+			return fmt.Errorf("port %s is already used by tunnel %q", port, owner)
+		}
+	}
+	return nil
+}
+
+func (tm *tunnelManager) StopAll() {
+	var wg sync.WaitGroup
+	for _, t := range tm.List() {
+		wg.Add(1)
+		go func(t *Tunnel) {
+			defer wg.Done()
+			t.Stop()
+		}(t)
+	}
+	wg.Wait()
+}
+
+func newYamuxConfig() *yamux.Config {
+	yamuxConfig := yamux.DefaultConfig()
+	yamuxConfig.KeepAliveInterval = 30 * time.Second
+	yamuxConfig.ConnectionWriteTimeout = 30 * time.Second
+	yamuxConfig.MaxStreamWindowSize = 2 * 1024 * 1024
+	return yamuxConfig
+}
+
+// =========================================================================
+//                             QUOTAS
+// =========================================================================
+
+// quotaState is one quota's usage in its current period. Usage is fed from
+// the same byte counts as the stats, so it matches bytes_in and bytes_out.
+type quotaState struct {
+	mu sync.Mutex
+	QuotaConfig
+	endpoint string
+	used     int64
+	start    time.Time
+	// warned is the highest level already logged, 100 once used up.
+	warned int
+	// throttle holds every connection under the quota to ThrottleKB once
+	// it is used up, and is unlimited otherwise.
+	throttle limiterPair
+}
+
+// quotaUsage is what is kept of a quota across restarts.
+type quotaUsage struct {
+	Start time.Time
+	Used  int64
+}
+
+func (q *quotaState) name() string {
+	if q.endpoint == "" {
+		return "the tunnel"
+	}
+	return q.endpoint
+}
+
+func (q *quotaState) covers(endpoint string) bool {
+	return q.endpoint == "" || q.endpoint == endpoint
+}
+
+// level is the highest warning level usage has reached, 100 once the
+// limit is. The caller holds q.mu.
+func (q *quotaState) level() int {
+	if q.used >= q.limit() {
+		return 100
+	}
+	percent := int(q.used * 100 / q.limit())
+	level := 0
+	for _, w := range q.WarnPercent {
+		if percent >= w {
+			level = max(level, w)
+		}
+	}
+	return level
+}
+
+// apply sets the throttle to match the usage. The caller holds q.mu.
+func (q *quotaState) apply() {
+	if q.Action == "throttle" && q.used >= q.limit() {
+		q.throttle.set(BandwidthLimit{InKB: q.ThrottleKB, OutKB: q.ThrottleKB})
+	} else {
+		q.throttle.set(BandwidthLimit{})
+	}
+}
+
+// rollover starts a new period once the current one is over. The caller
+// holds q.mu.
+func (q *quotaState) rollover(t *Tunnel, now time.Time) {
+	start := q.periodStart(now)
+	if !start.After(q.start) {
+		return
+	}
+	if q.used > 0 {
+		t.logf("🔄 Quota for %s starts a new period (%s used in the last one)", q.name(), formatBytes(q.used))
+	}
+	q.used, q.start, q.warned = 0, start, 0
+	q.apply()
+}
+
+// add counts traffic against the quota and logs each warning level the
+// first time usage passes it.
+func (q *quotaState) add(t *Tunnel, in, out int64) {
+	n := in + out
+	switch q.Count {
+	case "in":
+		n = in
+	case "out":
+		n = out
+	}
+	if n == 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover(t, time.Now())
+	q.used += n
+	level := q.level()
+	if level <= q.warned {
+		return
+	}
+	q.warned = level
+	if level < 100 {
+		t.logf("⚠️ Quota for %s is %d%% used (%s of %s)", q.name(), level, formatBytes(q.used), formatBytes(q.limit()))
+		return
+	}
+	q.apply()
+	if q.Action == "throttle" {
+		t.logf("⛔ Quota for %s is used up (%s); throttling it to %d KB/s%s", q.name(), formatBytes(q.limit()), q.ThrottleKB, q.until(time.Now()))
+	} else {
+		t.logf("⛔ Quota for %s is used up (%s); refusing new connections%s", q.name(), formatBytes(q.limit()), q.until(time.Now()))
+	}
+}
+
+func (q *quotaState) until(now time.Time) string {
+	if next := q.nextReset(now); !next.IsZero() {
+		return " until " + next.Format("2006-01-02 15:04")
+	}
+	return ""
+}
+
+// setQuotas installs cfg's quotas. A quota on the same port as before keeps
+// its usage; a new one picks up what was saved for its port, if anything.
+func (t *Tunnel) setQuotas(cfg *Config) {
+	current := map[string]*quotaState{}
+	if qs := t.quotas.Load(); qs != nil {
+		for _, q := range *qs {
+			current[q.endpoint] = q
+		}
+	}
+	var saved map[string]quotaUsage
+	if t.state != nil && len(cfg.Quotas) > 0 {
+		var err error
+		if saved, err = t.state.QuotaUsage(t.Name); err != nil {
+			t.logf("⚠️ Could not load quota usage: %v", err)
+		}
+	}
+
+	now := time.Now()
+	quotas := make([]*quotaState, 0, len(cfg.Quotas))
+	for _, qc := range cfg.Quotas {
+		endpoint := cfg.portEndpoint(qc.Port)
+		q := current[endpoint]
+		delete(current, endpoint)
+		if q == nil {
+			q = &quotaState{endpoint: endpoint, start: qc.periodStart(now)}
+			if u, ok := saved[endpoint]; ok {
+				q.start, q.used = u.Start, u.Used
+			}
+		}
+		q.mu.Lock()
+		q.QuotaConfig = qc
+		q.rollover(t, now)
+		// Levels reached before a restart or a config change are not
+		// logged again.
+		q.warned = q.level()
+		q.apply()
+		q.mu.Unlock()
+		quotas = append(quotas, q)
+	}
+	t.quotas.Store(&quotas)
+	for _, q := range current {
+		// Connections still open under a dropped quota are let go.
+		q.throttle.set(BandwidthLimit{})
+	}
+}
+
+// countQuotas is the stats hook that feeds every quota covering endpoint.
+func (t *Tunnel) countQuotas(endpoint string, in, out int64) {
+	qs := t.quotas.Load()
+	if qs == nil {
+		return
+	}
+	for _, q := range *qs {
+		if q.covers(endpoint) {
+			q.add(t, in, out)
+		}
+	}
+}
+
+// quotaRefusal returns why a new connection on endpoint is refused, or nil
+// while no quota that refuses connections is used up.
+func (t *Tunnel) quotaRefusal(endpoint string) error {
+	qs := t.quotas.Load()
+	if qs == nil {
+		return nil
+	}
+	now := time.Now()
+	for _, q := range *qs {
+		if !q.covers(endpoint) {
+			continue
+		}
+		q.mu.Lock()
+		q.rollover(t, now)
+		var err error
+		if q.Action == "refuse" && q.used >= q.limit() {
+			err = &rejection{"quota", fmt.Sprintf("the quota for %s (%s) is used up%s", q.name(), formatBytes(q.limit()), q.until(now))}
+		}
+		q.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quotaThrottles returns the throttles of every quota covering endpoint.
+func (t *Tunnel) quotaThrottles(endpoint string) []*limiterPair {
+	qs := t.quotas.Load()
+	if qs == nil {
+		return nil
+	}
+	var out []*limiterPair
+	for _, q := range *qs {
+		if q.covers(endpoint) {
+			out = append(out, &q.throttle)
+		}
+	}
+	return out
+}
+
+// ResetQuotas starts a new period now for the quota on port, or for every
+// quota when port is empty.
+func (t *Tunnel) ResetQuotas(port string) error {
+	qs := t.quotas.Load()
+	endpoint := t.Config().portEndpoint(port)
+	found := false
+	if qs != nil {
+		for _, q := range *qs {
+			if port != "" && q.endpoint != endpoint {
+				continue
+			}
+			found = true
+			q.mu.Lock()
+			q.used, q.start, q.warned = 0, time.Now(), 0
+			q.apply()
+			q.mu.Unlock()
+			t.logf("🔄 Quota for %s reset", q.name())
+		}
+	}
+	if !found {
+		if port == "" {
+			return errors.New("the tunnel has no quotas")
+		}
+		return fmt.Errorf("no quota on %s", port)
+	}
+	return nil
+}
+
+// quotaStatus is a quota as shown in /stats. Times are Unix seconds; a
+// quota that never resets has no resets_at.
+type quotaStatus struct {
+	Port        string  `json:"port,omitempty"`
+	LimitBytes  int64   `json:"limit_bytes"`
+	UsedBytes   int64   `json:"used_bytes"`
+	Percent     float64 `json:"percent"`
+	Count       string  `json:"count"`
+	Action      string  `json:"action"`
+	Exceeded    bool    `json:"exceeded"`
+	PeriodStart int64   `json:"period_start,omitempty"`
+	ResetsAt    int64   `json:"resets_at,omitempty"`
+}
+
+func (t *Tunnel) quotaStatus() []quotaStatus {
+	qs := t.quotas.Load()
+	if qs == nil {
+		return nil
+	}
+	now := time.Now()
+	var out []quotaStatus
+	for _, q := range *qs {
+		q.mu.Lock()
+		q.rollover(t, now)
+		st := quotaStatus{Port: q.endpoint, LimitBytes: q.limit(), UsedBytes: q.used, Count: q.Count, Action: q.Action,
+			Exceeded: q.used >= q.limit()}
+		st.Percent = math.Round(float64(q.used)*1000/float64(q.limit())) / 10
+		if !q.start.IsZero() {
+			st.PeriodStart = q.start.Unix()
+		}
+		if next := q.nextReset(now); !next.IsZero() {
+			st.ResetsAt = next.Unix()
+		}
+		q.mu.Unlock()
+		out = append(out, st)
+	}
+	return out
+}
+
+// quotaUsage returns the usage to save for each of the tunnel's quotas.
+func (t *Tunnel) quotaUsage() map[string]quotaUsage {
+	usage := map[string]quotaUsage{}
+	if qs := t.quotas.Load(); qs != nil {
+		for _, q := range *qs {
+			q.mu.Lock()
+			usage[q.endpoint] = quotaUsage{Start: q.start, Used: q.used}
+			q.mu.Unlock()
+		}
+	}
+	return usage
+}
+
+// recordQuotas saves quota usage every trafficSampleInterval until ctx
+// ends.
+func recordQuotas(ctx context.Context, tm *tunnelManager) {
+	ticker := time.NewTicker(trafficSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			saveQuotas(tm)
+		}
+	}
+}
+
+func saveQuotas(tm *tunnelManager) {
+	if tm.state == nil {
+		return
+	}
+	for _, t := range tm.List() {
+		if err := tm.state.SaveQuotaUsage(t.Name, t.quotaUsage()); err != nil {
+			log.Printf("Failed to save the quota usage of %q: %v", t.Name, err)
+		}
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 3; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %cB", float64(n)/float64(div), "KMGT"[exp])
+}
+
+// =========================================================================
+//                             ACCESS CONTROL
+// =========================================================================
+
+// rejection is a connection turned away by an access rule, a connection
+// limit or a quota. reason labels it in the metrics.
+type rejection struct {
+	reason string
+	detail string
+}
+
+func (r *rejection) Error() string {
+	return r.detail
+}
+
+// accessRules are the compiled access settings of one public port.
+type accessRules struct {
+	AccessConfig
+	allow, deny []netip.Prefix
+}
+
+// parsePrefixes parses IP addresses and CIDR ranges.
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		if p, err := netip.ParsePrefix(entry); err == nil {
+			prefixes = append(prefixes, p.Masked())
+		} else if ip, err := netip.ParseAddr(entry); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+		} else {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR range", entry)
+		}
+	}
+	return prefixes, nil
+}
+
+func prefixesContain(prefixes []netip.Prefix, ip netip.Addr) bool {
+	return slices.ContainsFunc(prefixes, func(p netip.Prefix) bool { return p.Contains(ip) })
+}
+
+// setAccess compiles cfg's access rules by endpoint; "" holds the rules for
+// ports without their own.
+func (t *Tunnel) setAccess(cfg *Config) {
+	rules := map[string]*accessRules{}
+	for _, ac := range cfg.Access {
+		r := &accessRules{AccessConfig: ac}
+		// Both lists were checked when the config was loaded.
+		r.allow, _ = parsePrefixes(ac.Allow)
+		r.deny, _ = parsePrefixes(ac.Deny)
+		rules[cfg.portEndpoint(ac.Port)] = r
+	}
+	t.access.Store(&rules)
+}
+
+// SetAccess replaces the access rules of the tunnel's public ports.
+// Connections already open are not affected.
+func (t *Tunnel) SetAccess(access []AccessConfig) {
+	t.mu.Lock()
+	t.cfg.Access = access
+	cfg := t.cfg.clone()
+	t.mu.Unlock()
+	t.setAccess(cfg)
+	t.logf("Access rules changed: %d set", len(access))
+}
+
+// admit decides whether a visitor from source ("ip:port") may open a
+// connection on a public port. It returns a func that frees the
+// connection's slot once it closes, or a rejection.
+func (t *Tunnel) admit(endpoint, source string) (func(), error) {
+	if err := t.quotaRefusal(endpoint); err != nil {
+		return nil, err
+	}
+	var r *accessRules
+	if rules := t.access.Load(); rules != nil {
+		if r = (*rules)[endpoint]; r == nil {
+			r = (*rules)[""]
+		}
+	}
+	if r == nil {
+		return func() {}, nil
+	}
+	ip := sourceIP(source)
+	if ip.IsValid() && prefixesContain(r.deny, ip) {
+		return nil, &rejection{"denied", ip.String() + " is on the deny list"}
+	}
+	if len(r.allow) > 0 && !(ip.IsValid() && prefixesContain(r.allow, ip)) {
+		who := source
+		if ip.IsValid() {
+			who = ip.String()
+		}
+		return nil, &rejection{"not_allowed", who + " is not on the allow list"}
+	}
+	return t.conns.acquire(endpoint, ip, r)
+}
+
+// countRefusal counts a connection that never got going: as rejected if
+// it was turned away, as an error otherwise.
+func (t *Tunnel) countRefusal(endpoint string, err error) {
+	var r *rejection
+	if errors.As(err, &r) {
+		t.stats.addRejected(endpoint, r.reason)
+		return
+	}
+	t.stats.addError(endpoint)
+}
+
+// connTracker counts the open connections of each public port and of each
+// source IP on it, and how many each IP opened in the current second.
+type connTracker struct {
+	mu        sync.Mutex
+	ports     map[string]int
+	ips       map[string]int
+	recent    map[string]*connWindow
+	lastSweep time.Time
+}
+
+type connWindow struct {
+	start time.Time
+	n     int
+}
+
+func (ct *connTracker) acquire(endpoint string, ip netip.Addr, r *accessRules) (func(), error) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if ct.ports == nil {
+		ct.ports, ct.ips, ct.recent = map[string]int{}, map[string]int{}, map[string]*connWindow{}
+	}
+	now := time.Now()
+	key := endpoint + " " + ip.String()
+	if r.NewConnectionsPerIP > 0 && ip.IsValid() {
+		ct.sweep(now)
+		w := ct.recent[key]
+		if w == nil || now.Sub(w.start) >= time.Second {
+			w = &connWindow{start: now}
+			ct.recent[key] = w
+		}
+		if w.n++; w.n > r.NewConnectionsPerIP {
+			return nil, &rejection{"rate", fmt.Sprintf("%s opened more than %d connections in a second", ip, r.NewConnectionsPerIP)}
+		}
+	}
+	if r.MaxConnections > 0 && ct.ports[endpoint] >= r.MaxConnections {
+		return nil, &rejection{"max_connections", fmt.Sprintf("%s is at its limit of %d connections", endpoint, r.MaxConnections)}
+	}
+	if r.MaxConnectionsPerIP > 0 && ip.IsValid() && ct.ips[key] >= r.MaxConnectionsPerIP {
+		return nil, &rejection{"max_connections_per_ip", fmt.Sprintf("%s already has %d connections open", ip, r.MaxConnectionsPerIP)}
+	}
+	ct.ports[endpoint]++
+	if ip.IsValid() {
+		ct.ips[key]++
+	}
+	return sync.OnceFunc(func() {
+		ct.mu.Lock()
+		defer ct.mu.Unlock()
+		if ct.ports[endpoint]--; ct.ports[endpoint] <= 0 {
+			delete(ct.ports, endpoint)
+		}
+		if ip.IsValid() {
+			if ct.ips[key]--; ct.ips[key] <= 0 {
+				delete(ct.ips, key)
+			}
+		}
+	}), nil
+}
+
+// sweep forgets the connection counts of past seconds. The caller holds
+// ct.mu.
+func (ct *connTracker) sweep(now time.Time) {
+	if now.Sub(ct.lastSweep) < time.Second {
+		return
+	}
+	ct.lastSweep = now
+	for key, w := range ct.recent {
+		if now.Sub(w.start) >= time.Second {
+			delete(ct.recent, key)
+		}
+	}
+}
+
+// =========================================================================
+//                             BANS
+// =========================================================================
+
+// banList counts failed tunnel logins by source IP and bans an IP that
+// fails max_failures times within window_ms. Each ban is twice as long as
+// the one before, up to max_ban_ms; an IP's earlier bans are forgotten
+// once it has kept clear for max_ban_ms.
+type banList struct {
+	mu        sync.Mutex
+	cfg       AuthBansConfig
+	ignore    []netip.Prefix
+	trusted   []netip.Prefix
+	failures  map[netip.Addr][]time.Time
+	bans      map[netip.Addr]*ban
+	lastSweep time.Time
+}
+
+// ban is an IP's latest ban. Strikes counts how many it has had.
+type ban struct {
+	IP      string    `json:"ip"`
+	Reason  string    `json:"reason"`
+	Since   time.Time `json:"since"`
+	Until   time.Time `json:"until"`
+	Strikes int       `json:"strikes"`
+}
+
+func (bl *banList) configure(cfg AuthBansConfig) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.cfg = cfg
+	// The lists were checked when the config was loaded.
+	bl.ignore, _ = parsePrefixes(cfg.Ignore)
+	bl.trusted, _ = parsePrefixes(cfg.TrustedProxies)
+}
+
+// clientAddr returns the address a wss request is banned by: the peer's,
+// or for a trusted proxy the rightmost untrusted IP in the client IP
+// header. It is "" when a trusted proxy sends no such IP, so that the
+// proxy itself is never banned.
+func (bl *banList) clientAddr(r *http.Request) string {
+	bl.mu.Lock()
+	trusted, header := bl.trusted, bl.cfg.ClientIPHeader
+	bl.mu.Unlock()
+	if ip := sourceIP(r.RemoteAddr); !ip.IsValid() || !prefixesContain(trusted, ip) {
+		return r.RemoteAddr
+	}
+	entries := strings.Split(strings.Join(r.Header.Values(header), ","), ",")
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := strings.TrimSpace(entries[i])
+		ip, err := netip.ParseAddr(entry)
+		if err != nil {
+			ap, err := netip.ParseAddrPort(entry)
+			if err != nil {
+				return ""
+			}
+			ip = ap.Addr()
+		}
+		if ip = ip.Unmap(); ip.Zone() != "" {
+			return ""
+		}
+		if !prefixesContain(trusted, ip) {
+			return netip.AddrPortFrom(ip, 0).String()
+		}
+	}
+	return ""
+}
+
+// fail counts a failed login and returns the ban it leads to, if any.
+func (bl *banList) fail(ip netip.Addr, reason string, now time.Time) *ban {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	if bl.cfg.Disabled || prefixesContain(bl.ignore, ip) {
+		return nil
+	}
+	if bl.failures == nil {
+		bl.failures, bl.bans = map[netip.Addr][]time.Time{}, map[netip.Addr]*ban{}
+	}
+	bl.sweep(now)
+	window := time.Duration(bl.cfg.WindowMs) * time.Millisecond
+	times := slices.DeleteFunc(bl.failures[ip], func(at time.Time) bool { return now.Sub(at) > window })
+	times = append(times, now)
+	if len(times) < bl.cfg.MaxFailures {
+		bl.failures[ip] = times
+		return nil
+	}
+	delete(bl.failures, ip)
+
+	b := bl.bans[ip]
+	if b == nil {
+		b = &ban{IP: ip.String()}
+		bl.bans[ip] = b
+	}
+	b.Strikes++
+	d := time.Duration(bl.cfg.BanMs) * time.Millisecond
+	maxBan := time.Duration(bl.cfg.MaxBanMs) * time.Millisecond
+	for i := 1; i < b.Strikes && d < maxBan; i++ {
+		d *= 2
+	}
+	d = min(d, maxBan)
+	b.Reason = fmt.Sprintf("%d failed logins within %s, the last: %s", len(times), window, reason)
+	b.Since, b.Until = now, now.Add(d)
+	cp := *b
+	return &cp
+}
+
+// success forgets the failures of an IP that logged in.
+func (bl *banList) success(ip netip.Addr) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	delete(bl.failures, ip)
+}
+
+func (bl *banList) banned(ip netip.Addr, now time.Time) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	b := bl.bans[ip]
+	return b != nil && now.Before(b.Until)
+}
+
+// active returns the bans in force, the soonest to end first.
+func (bl *banList) active(now time.Time) []ban {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	out := []ban{}
+	for _, b := range bl.bans {
+		if now.Before(b.Until) {
+			out = append(out, *b)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Until.Before(out[j].Until) })
+	return out
+}
+
+// records returns every ban still remembered, expired ones included, so
+// they can be saved.
+func (bl *banList) records() []ban {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.sweep(time.Now())
+	var out []ban
+	for _, b := range bl.bans {
+		out = append(out, *b)
+	}
+	return out
+}
+
+func (bl *banList) restore(bans []ban) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	if bl.failures == nil {
+		bl.failures, bl.bans = map[netip.Addr][]time.Time{}, map[netip.Addr]*ban{}
+	}
+	for _, b := range bans {
+		if ip, err := netip.ParseAddr(b.IP); err == nil {
+			bl.bans[ip] = &b
+		}
+	}
+}
+
+// clear lifts the ban on ip, and forgets its earlier bans and failures. An
+// invalid ip clears every IP. It returns how many bans were in force.
+func (bl *banList) clear(ip netip.Addr, now time.Time) int {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	lifted := 0
+	for addr, b := range bl.bans {
+		if ip.IsValid() && addr != ip {
+			continue
+		}
+		if now.Before(b.Until) {
+			lifted++
+		}
+		delete(bl.bans, addr)
+		delete(bl.failures, addr)
+	}
+	if !ip.IsValid() {
+		clear(bl.failures)
+	}
+	return lifted
+}
+
+// sweep drops failures outside the window and bans old enough to forget.
+// The caller holds bl.mu.
+func (bl *banList) sweep(now time.Time) {
+	if now.Sub(bl.lastSweep) < time.Minute {
+		return
+	}
+	bl.lastSweep = now
+	window := time.Duration(bl.cfg.WindowMs) * time.Millisecond
+	for ip, times := range bl.failures {
+		if now.Sub(times[len(times)-1]) > window {
+			delete(bl.failures, ip)
+		}
+	}
+	memory := time.Duration(bl.cfg.MaxBanMs) * time.Millisecond
+	for ip, b := range bl.bans {
+		if now.Sub(b.Until) > memory {
+			delete(bl.bans, ip)
+		}
+	}
+}
+
+// sourceIP returns the IP of an "ip:port" address, or the zero Addr.
+func sourceIP(addr string) netip.Addr {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ap.Addr().Unmap()
+}
+
+// isBanned reports whether a tunnel connection from addr is to be dropped
+// without a handshake.
+func (t *Tunnel) isBanned(addr string) bool {
+	ip := sourceIP(addr)
+	if !ip.IsValid() || !t.bans.banned(ip, time.Now()) {
+		return false
+	}
+	metricBannedConnections.Add(1, t.Name)
+	return true
+}
+
+// authFailed counts a failed tunnel login from addr and bans the IP once it
+// fails too often. Connections closed before saying anything, such as
+// load balancer health checks, do not count.
+func (t *Tunnel) authFailed(addr string, err error) {
+	ip := sourceIP(addr)
+	if errors.Is(err, errNoHello) || !ip.IsValid() {
+		return
+	}
+	b := t.bans.fail(ip, err.Error(), time.Now())
+	if b == nil {
+		return
+	}
+	t.logf("[Server] ⛔ Banned %s until %s (ban #%d): %s", b.IP, b.Until.Format("2006-01-02 15:04:05"), b.Strikes, b.Reason)
+	t.saveBans()
+}
+
+func (t *Tunnel) authSucceeded(addr string) {
+	if ip := sourceIP(addr); ip.IsValid() {
+		t.bans.success(ip)
+	}
+}
+
+// Bans returns the IPs banned from the tunnel's listener.
+func (t *Tunnel) Bans() []ban {
+	return t.bans.active(time.Now())
+}
+
+// ClearBans lifts the ban on ip, or every ban when ip is empty.
+func (t *Tunnel) ClearBans(ip string) (int, error) {
+	var addr netip.Addr
+	if ip != "" {
+		var err error
+		if addr, err = netip.ParseAddr(ip); err != nil {
+			return 0, fmt.Errorf("invalid IP %q", ip)
+		}
+		addr = addr.Unmap()
+	}
+	n := t.bans.clear(addr, time.Now())
+	t.saveBans()
+	return n, nil
+}
+
+// SetAuthBans changes when the tunnel bans IPs. Bans in force stay.
+func (t *Tunnel) SetAuthBans(cfg AuthBansConfig) {
+	t.mu.Lock()
+	t.cfg.AuthBans = cfg
+	t.mu.Unlock()
+	t.bans.configure(cfg)
+	t.logf("Auth ban settings changed")
+}
+
+// loadBans picks up the bans saved before the last restart.
+func (t *Tunnel) loadBans() {
+	if t.state == nil {
+		return
+	}
+	bans, err := t.state.Bans(t.Name)
+	if err != nil {
+		t.logf("⚠️ Could not load bans: %v", err)
+		return
+	}
+	t.bans.restore(bans)
+	if n := len(t.Bans()); n > 0 {
+		t.logf("[Server] %d IPs are still banned", n)
+	}
+}
+
+func (t *Tunnel) saveBans() {
+	if t.state == nil {
+		return
+	}
+	if err := t.state.SaveBans(t.Name, t.bans.records()); err != nil {
+		t.logf("⚠️ Could not save bans: %v", err)
+	}
+}
+
+// =========================================================================
+//                             AUTHENTICATION
+// =========================================================================
+
+// Clients never send the token itself. On tcpmux and QUIC the server sends a
+// fresh nonce and the client answers with HMAC-SHA256(token, nonce, time).
+// WSS has no round trip before the upgrade, so the client signs its own
+// nonce and the server remembers nonces it has seen within the window.
+const (
+	authVersion   = 1
+	authNonceSize = 32
+	authWindow    = 30 * time.Second
+	authLabel     = "phantom-auth-v1"
+)
+
+type authenticator struct {
+	token string
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// errNoHello is a connection closed before the handshake began, as port
+// scanners and health checks do.
+var errNoHello = errors.New("closed before the auth hello")
+
+func newAuthenticator(token string) *authenticator {
+	return &authenticator{token: token, seen: make(map[string]time.Time)}
+}
+
+func authMAC(token, scope string, nonce []byte, ts int64) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(authLabel))
+	mac.Write([]byte{0})
+	mac.Write([]byte(scope))
+	mac.Write([]byte{0})
+	mac.Write(nonce)
+	var tsBuf [8]byte
+	binary.BigEndian.PutUint64(tsBuf[:], uint64(ts))
+	mac.Write(tsBuf[:])
+	return mac.Sum(nil)
+}
+
+func (a *authenticator) checkTime(ts int64) error {
+	skew := time.Since(time.Unix(ts, 0))
+	if skew > authWindow || skew < -authWindow {
+		return fmt.Errorf("timestamp outside the %s window (clock skew %s)", authWindow, skew.Round(time.Second))
+	}
+	return nil
+}
+
+// remember records a nonce from a WSS auth header and reports false if it
+// was already used inside the replay window.
+func (a *authenticator) remember(nonce []byte) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for k, at := range a.seen {
+		if now.Sub(at) > 2*authWindow {
+			delete(a.seen, k)
+		}
+	}
+	key := string(nonce)
+	if _, ok := a.seen[key]; ok {
+		return false
+	}
+	a.seen[key] = now
+	return true
+}
+
+// serverHandshake runs the challenge-response over a freshly accepted
+// connection or QUIC auth stream.
+func (a *authenticator) serverHandshake(rw io.ReadWriter) error {
+	hello := make([]byte, 1)
+	if _, err := io.ReadFull(rw, hello); errors.Is(err, io.EOF) {
+		return errNoHello
+	} else if err != nil {
+		return fmt.Errorf("reading hello: %w", err)
+	}
+	if hello[0] != authVersion {
+		return fmt.Errorf("unsupported auth version %d", hello[0])
+	}
+	nonce := make([]byte, authNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if _, err := rw.Write(nonce); err != nil {
+		return err
+	}
+	resp := make([]byte, 8+sha256.Size)
+	if _, err := io.ReadFull(rw, resp); err != nil {
+		return fmt.Errorf("reading response: %w", err)
+	}
+	if a.token != "" {
+		ts := int64(binary.BigEndian.Uint64(resp[:8]))
+		if err := a.checkTime(ts); err != nil {
+			return err
+		}
+		// The nonce is fresh from this server, so a response to it cannot
+		// be a replay.
+		if !hmac.Equal(resp[8:], authMAC(a.token, "stream", nonce, ts)) {
+			return errors.New("invalid token")
+		}
+	}
+	_, err := rw.Write([]byte{1})
+	return err
+}
+
+func clientHandshake(rw io.ReadWriter, token string) error {
+	if _, err := rw.Write([]byte{authVersion}); err != nil {
+		return err
+	}
+	nonce := make([]byte, authNonceSize)
+	if _, err := io.ReadFull(rw, nonce); err != nil {
+		return fmt.Errorf("reading challenge: %w", err)
+	}
+	ts := time.Now().Unix()
+	resp := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(resp, uint64(ts))
+	resp = append(resp, authMAC(token, "stream", nonce, ts)...)
+	if _, err := rw.Write(resp); err != nil {
+		return err
+	}
+	ack := make([]byte, 1)
+	if _, err := io.ReadFull(rw, ack); err != nil || ack[0] != 1 {
+		return errors.New("authentication rejected by server")
+	}
+	return nil
+}
+
+// wssAuthHeader builds the X-Auth-Token value: "v1.<unix time>.<nonce>.<mac>".
+func wssAuthHeader(token, path string) string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	ts := time.Now().Unix()
+	return fmt.Sprintf("v%d.%d.%s.%s", authVersion, ts, hex.EncodeToString(nonce),
+		hex.EncodeToString(authMAC(token, "wss:"+path, nonce, ts)))
+}
+
+func (a *authenticator) checkWSSHeader(value, path string) error {
+	if a.token == "" {
+		return nil
+	}
+	parts := strings.Split(value, ".")
+	if len(parts) != 4 || parts[0] != fmt.Sprintf("v%d", authVersion) {
+		return errors.New("malformed auth header")
+	}
+	ts, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return errors.New("malformed auth timestamp")
+	}
+	nonce, err1 := hex.DecodeString(parts[2])
+	mac, err2 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || len(nonce) < 16 {
+		return errors.New("malformed auth header")
+	}
+	if err := a.checkTime(ts); err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, authMAC(a.token, "wss:"+path, nonce, ts)) {
+		return errors.New("invalid token")
+	}
+	if !a.remember(nonce) {
+		return errors.New("replayed auth header")
+	}
+	return nil
+}
+
+// =========================================================================
+//                             STREAM PROTOCOL
+// =========================================================================
+
+// Every stream the server opens starts with a header naming the target.
+// Version 1 is the original single port-index byte. Version 2 is
+//
+//	u8  version (2)
+//	u16 length of the rest
+//	u16 target index
+//	u8  source address length, source address ("ip:port" of the visitor)
+//	u8  metadata count, then per entry: u8 key length, key, u16 value length, value
+//
+// Bytes after the known fields are skipped, so later versions can append
+// fields without breaking this parser. Version 2 is only used once the
+// client has asked for it in its hello on the control stream; clients that
+// never send one keep getting version 1.
+const (
+	streamVersion1   = 1
+	streamVersion2   = 2
+	maxStreamVersion = streamVersion2
+	maxHeaderSize    = 16 * 1024
+	maxControlSize   = 64 * 1024
+	// helloTimeout is how long each side waits for the other's hello
+	// before assuming it is an older build.
+	helloTimeout = 3 * time.Second
+	// dynamicPortIndex is the target of ports a client opened itself.
+	// Streams for them are always routed by service name.
+	dynamicPortIndex = 0xFFFF
+)
+
+type streamHeader struct {
+	Target int
+	Source string
+	Meta   map[string]string
+}
+
+func (h *streamHeader) marshal(version int) ([]byte, error) {
+	if version < streamVersion2 {
+		if h.Target < 0 || h.Target > 255 {
+			return nil, fmt.Errorf("target %d does not fit a version 1 header", h.Target)
+		}
+		return []byte{byte(h.Target)}, nil
+	}
+	if h.Target < 0 || h.Target > 0xFFFF {
+		return nil, fmt.Errorf("target %d out of range", h.Target)
+	}
+	if len(h.Source) > 255 || len(h.Meta) > 255 {
+		return nil, errors.New("stream header fields too long")
+	}
+	body := binary.BigEndian.AppendUint16(nil, uint16(h.Target))
+	body = append(body, byte(len(h.Source)))
+	body = append(body, h.Source...)
+	body = append(body, byte(len(h.Meta)))
+	keys := make([]string, 0, len(h.Meta))
+	for k := range h.Meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := h.Meta[k]
+		if len(k) > 255 || len(v) > 0xFFFF {
+			return nil, fmt.Errorf("metadata %q too long", k)
+		}
+		body = append(body, byte(len(k)))
+		body = append(body, k...)
+		body = binary.BigEndian.AppendUint16(body, uint16(len(v)))
+		body = append(body, v...)
+	}
+	if len(body) > maxHeaderSize {
+		return nil, errors.New("stream header too long")
+	}
+	out := []byte{streamVersion2}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(body)))
+	return append(out, body...), nil
+}
+
+func writeStreamHeader(w io.Writer, version int, h *streamHeader) error {
+	buf, err := h.marshal(version)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// readStreamHeader reads the header of a stream in the negotiated version.
+func readStreamHeader(r io.Reader, version int) (*streamHeader, error) {
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(r, first); err != nil {
+		return nil, err
+	}
+	if version < streamVersion2 {
+		return &streamHeader{Target: int(first[0])}, nil
+	}
+	if first[0] < streamVersion2 {
+		return nil, fmt.Errorf("unsupported stream header version %d", first[0])
+	}
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(r, lenBuf); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(lenBuf))
+	if n > maxHeaderSize {
+		return nil, fmt.Errorf("stream header of %d bytes is too long", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return parseStreamHeader(body)
+}
+
+// parseStreamHeader decodes the body of a version 2 header.
+func parseStreamHeader(body []byte) (*streamHeader, error) {
+	errShort := errors.New("truncated stream header")
+	take := func(n int) ([]byte, bool) {
+		if len(body) < n {
+			return nil, false
+		}
+		b := body[:n]
+		body = body[n:]
+		return b, true
+	}
+	b, ok := take(3)
+	if !ok {
+		return nil, errShort
+	}
+	h := &streamHeader{Target: int(binary.BigEndian.Uint16(b))}
+	src, ok := take(int(b[2]))
+	if !ok {
+		return nil, errShort
+	}
+	h.Source = string(src)
+	count, ok := take(1)
+	if !ok {
+		return nil, errShort
+	}
+	for i := 0; i < int(count[0]); i++ {
+		kl, ok := take(1)
+		if !ok {
+			return nil, errShort
+		}
+		k, ok := take(int(kl[0]))
+		if !ok {
+			return nil, errShort
+		}
+		vl, ok := take(2)
+		if !ok {
+			return nil, errShort
+		}
+		v, ok := take(int(binary.BigEndian.Uint16(vl)))
+		if !ok {
+			return nil, errShort
+		}
+		if h.Meta == nil {
+			h.Meta = map[string]string{}
+		}
+		h.Meta[string(k)] = string(v)
+	}
+	return h, nil
+}
+
+// controlMessage is what client and server exchange on the control stream,
+// the first stream a client opens after connecting. Each message is a
+// u32 length followed by JSON.
+//
+// After the hello the client may send "open_port" requests naming a service
+// and a port or range; the server answers each with "port_opened" and the
+// port it chose, or "error".
+type controlMessage struct {
+	Type          string   `json:"type"`
+	StreamVersion int      `json:"stream_version,omitempty"`
+	Services      []string `json:"services,omitempty"`
+	Features      []string `json:"features,omitempty"`
+	Service       string   `json:"service,omitempty"`
+	Port          string   `json:"port,omitempty"`
+	Error         string   `json:"error,omitempty"`
+	// Refused is set on a failed "dial_result" when the allow-list, not
+	// the network, turned the destination down.
+	Refused bool `json:"refused,omitempty"`
+}
+
+func writeControl(w io.Writer, msg *controlMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	_, err = w.Write(append(buf, data...))
+	return err
+}
+
+func readControl(r io.Reader) (*controlMessage, error) {
+	lenBuf := make([]byte, 4)
+	if _, err := io.ReadFull(r, lenBuf); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(lenBuf)
+	if n > maxControlSize {
+		return nil, fmt.Errorf("control message of %d bytes is too long", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	msg := &controlMessage{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// UDP streams carry one datagram per frame: a u16 length and the payload.
+const maxDatagramSize = 65535
+
+func writeDatagram(w io.Writer, data []byte) error {
+	frame := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(data)), uint16(len(data)))
+	_, err := w.Write(append(frame, data...))
+	return err
+}
+
+func readDatagram(r io.Reader) ([]byte, error) {
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(r, lenBuf); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(lenBuf))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// clientSession is a client's session on the server together with what
+// was negotiated over its control stream.
+type clientSession struct {
+	muxSession
+	streamVersion int
+	control       net.Conn
+	// services are the named targets the client advertised. Named ports
+	// only go to clients that advertise the name; unnamed ports are matched
+	// by position and go to any client.
+	services []string
+	// features are the optional abilities the client announced, such as
+	// "udp".
+	features []string
+	// claims are the dynamic ports this session asked for, guarded by the
+	// tunnel's mu.
+	claims []string
+}
+
+func (cs *clientSession) offers(service string) bool {
+	return service == "" || slices.Contains(cs.services, service)
+}
+
+// supports reports whether the client can take streams for network, or
+// for proxy exits.
+func (cs *clientSession) supports(network string) bool {
+	return network == "tcp" || slices.Contains(cs.features, network)
+}
+
+// acceptHello waits briefly for the client's control stream and agrees on
+// the stream header version. Clients that open none are older builds and
+// get version 1; they only join the pool once helloTimeout has passed. A
+// control stream that arrives after that is closed.
+func (t *Tunnel) acceptHello(session muxSession) *clientSession {
+	cs := &clientSession{muxSession: session, streamVersion: streamVersion1}
+	accepted, gaveUp := make(chan net.Conn), make(chan struct{})
+	go func() {
+		// Older clients never open a stream, so this returns only when
+		// the session ends.
+		stream, err := session.AcceptStream()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		select {
+		case accepted <- stream:
+		case <-gaveUp:
+			stream.Close()
+		}
+	}()
+
+	var control net.Conn
+	select {
+	case control = <-accepted:
+	case <-time.After(helloTimeout):
+		close(gaveUp)
+	}
+	if control == nil {
+		return cs
+	}
+	control.SetDeadline(time.Now().Add(helloTimeout))
+	msg, err := readControl(control)
+	if err != nil || msg.Type != "hello" {
+		t.logf("[Server] Bad hello from %s: %v", session.RemoteAddr(), err)
+		control.Close()
+		return cs
+	}
+	cs.streamVersion = min(max(msg.StreamVersion, streamVersion1), maxStreamVersion)
+	cs.services = msg.Services
+	cs.features = msg.Features
+	if cs.streamVersion < streamVersion2 {
+		// Service names and the network travel in the version 2 header.
+		cs.services, cs.features = nil, nil
+	}
+	reply := &controlMessage{Type: "hello", StreamVersion: cs.streamVersion, Features: []string{"forward"}}
+	if err := writeControl(control, reply); err != nil {
+		control.Close()
+		return cs
+	}
+	control.SetDeadline(time.Time{})
+	cs.control = control
+	return cs
+}
+
+// sendHello opens the control stream and asks for the newest stream header
+// version. A server that does not answer in time is an older build.
+func sendHello(session muxSession, services, features []string) (version int, serverFeatures []string, control net.Conn) {
+	control, err := session.OpenStream()
+	if err != nil {
+		return streamVersion1, nil, nil
+	}
+	control.SetDeadline(time.Now().Add(helloTimeout))
+	hello := &controlMessage{Type: "hello", StreamVersion: maxStreamVersion, Services: services, Features: features}
+	if err := writeControl(control, hello); err != nil {
+		control.Close()
+		return streamVersion1, nil, nil
+	}
+	msg, err := readControl(control)
+	if err != nil || msg.Type != "hello" {
+		// Leave the stream open: an older server never accepts it, and
+		// closing it would only add noise on its side.
+		return streamVersion1, nil, nil
+	}
+	control.SetDeadline(time.Time{})
+	return min(max(msg.StreamVersion, streamVersion1), maxStreamVersion), msg.Features, control
+}
+
+// =========================================================================
+//                             PROXY PROTOCOL
+// =========================================================================
+
+// PROXY protocol headers tell a backend who the visitor really is. The
+// client can prepend one to the connections it makes to local targets, and
+// server public listeners can require one from a load balancer in front.
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	maxProxyV1Line = 107
+	maxProxyV2Body = 4096
+)
+
+// proxyHeader builds a version 1 or 2 header for a connection from src to
+// dst. If either address does not parse, the header says UNKNOWN (v1) or
+// LOCAL (v2), which makes the backend use the connection's own addresses.
+func proxyHeader(version int, src, dst string) []byte {
+	s, err1 := netip.ParseAddrPort(src)
+	d, err2 := netip.ParseAddrPort(dst)
+	known := err1 == nil && err2 == nil
+	if known {
+		s = netip.AddrPortFrom(s.Addr().Unmap(), s.Port())
+		d = netip.AddrPortFrom(d.Addr().Unmap(), d.Port())
+		if s.Addr().Is4() != d.Addr().Is4() {
+			// Mixed families are sent as IPv6, with IPv4 mapped into it.
+			s = netip.AddrPortFrom(netip.AddrFrom16(s.Addr().As16()), s.Port())
+			d = netip.AddrPortFrom(netip.AddrFrom16(d.Addr().As16()), d.Port())
+		}
+	}
+
+	if version == 1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP6"
+		if s.Addr().Is4() {
+			family = "TCP4"
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, s.Addr(), d.Addr(), s.Port(), d.Port())
+	}
+
+	buf := append([]byte(nil), proxyV2Signature...)
+	if !known {
+		return append(buf, 0x20, 0x00, 0x00, 0x00)
+	}
+	var addrs []byte
+	family := byte(0x21) // TCP over IPv6
+	if s.Addr().Is4() {
+		family = 0x11 // TCP over IPv4
+		a, b := s.Addr().As4(), d.Addr().As4()
+		addrs = append(append(addrs, a[:]...), b[:]...)
+	} else {
+		a, b := s.Addr().As16(), d.Addr().As16()
+		addrs = append(append(addrs, a[:]...), b[:]...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, s.Port())
+	addrs = binary.BigEndian.AppendUint16(addrs, d.Port())
+	buf = append(buf, 0x21, family)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(addrs)))
+	return append(buf, addrs...)
+}
+
+// readProxyHeader reads a version 1 or 2 header and returns the addresses
+// it announces, or empty strings for UNKNOWN and LOCAL headers.
+func readProxyHeader(r *bufio.Reader) (src, dst string, err error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return "", "", fmt.Errorf("reading PROXY header: %w", err)
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if !bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return "", "", errors.New("connection did not start with a PROXY header")
+	}
+
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > maxProxyV1Line || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return "", "", errors.New("malformed PROXY v1 header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return "", "", nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return "", "", errors.New("malformed PROXY v1 header")
+	}
+	s, err1 := netip.ParseAddr(fields[2])
+	d, err2 := netip.ParseAddr(fields[3])
+	sp, err3 := strconv.ParseUint(fields[4], 10, 16)
+	dp, err4 := strconv.ParseUint(fields[5], 10, 16)
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		return "", "", fmt.Errorf("malformed PROXY v1 header: %w", err)
+	}
+	if s.Zone() != "" || d.Zone() != "" {
+		return "", "", errors.New("malformed PROXY v1 header: addresses cannot have a zone")
+	}
+	return netip.AddrPortFrom(s.Unmap(), uint16(sp)).String(), netip.AddrPortFrom(d.Unmap(), uint16(dp)).String(), nil
+}
+
+func readProxyV2(r *bufio.Reader) (src, dst string, err error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return "", "", fmt.Errorf("reading PROXY v2 header: %w", err)
+	}
+	if head[12]>>4 != 2 {
+		return "", "", fmt.Errorf("unsupported PROXY v2 version %d", head[12]>>4)
+	}
+	n := int(binary.BigEndian.Uint16(head[14:]))
+	if n > maxProxyV2Body {
+		return "", "", fmt.Errorf("PROXY v2 header of %d bytes is too long", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return "", "", fmt.Errorf("reading PROXY v2 header: %w", err)
+	}
+	if head[12]&0x0F == 0 {
+		// LOCAL: a health check from the proxy itself.
+		return "", "", nil
+	}
+	var s, d netip.Addr
+	var ports []byte
+	switch head[13] >> 4 {
+	case 1:
+		if n < 12 {
+			return "", "", errors.New("short PROXY v2 IPv4 address block")
+		}
+		s, d, ports = netip.AddrFrom4([4]byte(body[0:4])), netip.AddrFrom4([4]byte(body[4:8])), body[8:12]
+	case 2:
+		if n < 36 {
+			return "", "", errors.New("short PROXY v2 IPv6 address block")
+		}
+		s, d, ports = netip.AddrFrom16([16]byte(body[0:16])), netip.AddrFrom16([16]byte(body[16:32])), body[32:36]
+	default:
+		// UNSPEC or unix sockets carry nothing we can pass on.
+		return "", "", nil
+	}
+	return netip.AddrPortFrom(s.Unmap(), binary.BigEndian.Uint16(ports)).String(),
+		netip.AddrPortFrom(d.Unmap(), binary.BigEndian.Uint16(ports[2:])).String(), nil
+}
+
+// bufferedConn reads through the bufio.Reader a PROXY header was parsed
+// from, so bytes it buffered past the header are not lost.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// =========================================================================
+//                             SERVER LOGIC
+// =========================================================================
+
+func (t *Tunnel) runServer(ctx context.Context) error {
+	cfg := t.cfg
+	t.logf("[Server Mode] 🚀 Starting in %s mode...", cfg.Transport)
+	if !validBalancePolicy(cfg.Balance) {
+		return fmt.Errorf("unknown balance policy: %s", cfg.Balance)
+	}
+	pool := newSessionPool(cfg.Balance)
+	defer pool.CloseAll()
+	auth := newAuthenticator(cfg.Token)
+
+	t.mu.Lock()
+	t.runCtx, t.pool, t.ports = ctx, pool, map[string]context.CancelFunc{}
+	t.dynamic = map[string]*dynamicPort{}
+	for i, port := range cfg.PublicPorts {
+		if port == "" {
+			continue
+		}
+		if err := t.openPortLocked(port, i); err != nil {
+			t.logf("[Server] FATAL: Could not listen on public port %s: %v", publicAddr(port), err)
+		}
+	}
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		for addr := range t.dynamic {
+			t.stats.removeEndpoint(addr)
+		}
+		t.runCtx, t.pool, t.ports, t.dynamic = nil, nil, nil, nil
+		t.mu.Unlock()
+	}()
+	t.stats.registerEndpoints(cfg.endpoints())
+
+	if cfg.Proxy.Listen != "" {
+		ln, err := net.Listen("tcp", cfg.Proxy.Listen)
+		if err != nil {
+			return fmt.Errorf("proxy listener failed on %s: %w", cfg.Proxy.Listen, err)
+		}
+		go t.startProxyListener(ctx, ln, pool)
+	}
+
+	switch cfg.Transport {
+	case "wss":
+		return t.listenWSS(ctx, pool, auth)
+	case "tcpmux", "tcpmux+tls":
+		return t.listenTCPMux(ctx, pool, auth)
+	case "quic":
+		return t.listenQUIC(ctx, pool, auth)
+	default:
+		return fmt.Errorf("unknown tunnel type: %s", cfg.Transport)
+	}
+}
+
+func (t *Tunnel) startPublicListener(ctx context.Context, publicListener net.Listener, publicAddr string, portIndex int, service string, pool *sessionPool) {
+	defer publicListener.Close()
+	stop := context.AfterFunc(ctx, func() { publicListener.Close() })
+	defer stop()
+	if service != "" {
+		t.logf("[Server] ✅ Listening for public traffic on %s (Service: %s)", publicAddr, service)
+	} else {
+		t.logf("[Server] ✅ Listening for public traffic on %s (Index: %d)", publicAddr, portIndex)
+	}
+
+	for {
+		publicConn, err := publicListener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+
+		go func(publicConn net.Conn) {
+			defer publicConn.Close()
+			source, destination := publicConn.RemoteAddr().String(), publicConn.LocalAddr().String()
+			if t.cfg.AcceptProxyProtocol {
+				br := bufio.NewReader(publicConn)
+				publicConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				src, dst, err := readProxyHeader(br)
+				publicConn.SetReadDeadline(time.Time{})
+				if err != nil {
+					t.logf("[Server] ⛔ Rejected connection on %s from %s: %v", publicAddr, source, err)
+					t.stats.addError(publicAddr)
+					return
+				}
+				if src != "" {
+					source, destination = src, dst
+				}
+				publicConn = &bufferedConn{Conn: publicConn, r: br}
+			}
+			release, err := t.admit(publicAddr, source)
+			if err != nil {
+				t.logf("[Server] ⛔ Rejected connection on %s from %s: %v", publicAddr, source, err)
+				t.countRefusal(publicAddr, err)
+				return
+			}
+			defer release()
+			sess := pool.Get(service, "tcp")
+			if sess == nil {
+				if service != "" && pool.Len() > 0 {
+					t.logf("[Server] ⛔ Rejected connection on %s: no client offers service %q", publicAddr, service)
+				}
+				t.stats.addError(publicAddr)
+				return
+			}
+
+			opened := time.Now()
+			stream, err := sess.OpenStream()
+			if err != nil {
+				t.stats.addError(publicAddr)
+				return
+			}
+			defer stream.Close()
+
+			t.stats.addActive(publicAddr, 1)
+			defer t.stats.addActive(publicAddr, -1)
+
+			header := &streamHeader{
+				Target: portIndex,
+				Source: source,
+				Meta:   map[string]string{"listener": publicAddr, "destination": destination},
+			}
+			if service != "" {
+				header.Meta["service"] = service
+			}
+			stream.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			err = writeStreamHeader(stream, sess.streamVersion, header)
+			stream.SetWriteDeadline(time.Time{})
+			if err != nil {
+				t.logf("[Server] Failed to send stream header to client: %v", err)
+				t.stats.addError(publicAddr)
+				return
+			}
+			metricStreamOpen.Observe(time.Since(opened).Seconds(), t.Name, publicAddr)
+
+			sh := t.shaper(publicAddr, source)
+			defer sh.release()
+			c := &shapedConn{Conn: publicConn, s: sh, visitor: true}
+
+			go pipeCount(stream, c, t.stats.countIn(publicAddr), t.cfg.Fragment.Size, t.cfg.Fragment.DelayMs)
+			pipeCount(c, stream, t.stats.countOut(publicAddr), 0, 0)
+		}(publicConn)
+	}
+}
+
+// udpPeer is one remote address sending to a UDP public port. Its
+// datagrams travel as frames on a stream of its own.
+type udpPeer struct {
+	queue chan []byte
+}
+
+// udpQueueLen is how many datagrams may wait for a peer's stream before
+// more are dropped, as a congested network would.
+const udpQueueLen = 256
+
+// udpRejectWindow is how long the datagrams of a peer that was turned
+// away, by the access rules or for want of a client taking UDP, are
+// dropped before it is checked again.
+const udpRejectWindow = 10 * time.Second
+
+func (t *Tunnel) startUDPListener(ctx context.Context, pc net.PacketConn, publicAddr string, portIndex int, service string, pool *sessionPool) {
+	defer pc.Close()
+	stop := context.AfterFunc(ctx, func() { pc.Close() })
+	defer stop()
+	if service != "" {
+		t.logf("[Server] ✅ Listening for public UDP traffic on %s (Service: %s)", publicAddr, service)
+	} else {
+		t.logf("[Server] ✅ Listening for public UDP traffic on %s (Index: %d)", publicAddr, portIndex)
+	}
+
+	var mu sync.Mutex
+	peers := map[string]*udpPeer{}
+	// rejected holds when each refused peer may be checked again. Only
+	// this loop uses it, and it is capped like peers.
+	rejected := map[string]time.Time{}
+	maxPeers := t.cfg.MaxUDPPeers
+	reject := func(key string, now time.Time) bool {
+		if len(rejected) >= maxPeers {
+			for k, until := range rejected {
+				if now.After(until) {
+					delete(rejected, k)
+				}
+			}
+		}
+		if len(rejected) >= maxPeers {
+			return false
+		}
+		rejected[key] = now.Add(udpRejectWindow)
+		return true
+	}
+	// Datagrams turned away for want of room, and peers for want of a
+	// client, are logged at most once a minute, with how many there were.
+	var dropped, unserved int
+	var lastDropLog, lastUnservedLog time.Time
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		key := from.String()
+		now := time.Now()
+		if until, ok := rejected[key]; ok {
+			if now.Before(until) {
+				continue
+			}
+			delete(rejected, key)
+		}
+		mu.Lock()
+		p := peers[key]
+		if p == nil && len(peers) >= maxPeers {
+			mu.Unlock()
+			if dropped++; time.Since(lastDropLog) >= time.Minute {
+				t.logf("[Server] ⛔ Dropped %d datagrams from new UDP peers on %s: max_udp_peers (%d) reached", dropped, publicAddr, maxPeers)
+				dropped, lastDropLog = 0, time.Now()
+			}
+			continue
+		}
+		if p == nil {
+			release, err := t.admit(publicAddr, key)
+			if err != nil {
+				mu.Unlock()
+				t.countRefusal(publicAddr, err)
+				if reject(key, now) {
+					t.logf("[Server] ⛔ Dropped UDP peer %s on %s: %v", from, publicAddr, err)
+				}
+				continue
+			}
+			sess := pool.Get(service, "udp")
+			if sess == nil {
+				mu.Unlock()
+				release()
+				t.stats.addError(publicAddr)
+				reject(key, now)
+				if unserved++; time.Since(lastUnservedLog) >= time.Minute {
+					t.logf("[Server] ⛔ Dropped %d new UDP peers on %s: no connected client takes UDP for it", unserved, publicAddr)
+					unserved, lastUnservedLog = 0, time.Now()
+				}
+				continue
+			}
+			p = &udpPeer{queue: make(chan []byte, udpQueueLen)}
+			peers[key] = p
+			go func() {
+				t.serveUDPPeer(ctx, pc, from, p, release, publicAddr, portIndex, service, sess)
+				mu.Lock()
+				delete(peers, key)
+				mu.Unlock()
+			}()
+		}
+		mu.Unlock()
+		select {
+		case p.queue <- bytes.Clone(buf[:n]):
+		default:
+		}
+	}
+}
+
+// serveUDPPeer opens a stream on sess for one admitted peer and relays its
+// datagrams until either side has been idle for udp_idle_timeout_ms, then
+// calls release.
+func (t *Tunnel) serveUDPPeer(ctx context.Context, pc net.PacketConn, peer net.Addr, p *udpPeer, release func(), publicAddr string, portIndex int, service string, sess *clientSession) {
+	defer release()
+	stream, err := sess.OpenStream()
+	if err != nil {
+		t.stats.addError(publicAddr)
+		return
+	}
+	closed := make(chan struct{})
+	shut := sync.OnceFunc(func() {
+		stream.Close()
+		close(closed)
+	})
+	defer shut()
+	stop := context.AfterFunc(ctx, shut)
+	defer stop()
+
+	header := &streamHeader{
+		Target: portIndex,
+		Source: peer.String(),
+		Meta:   map[string]string{"listener": publicAddr, "network": "udp", "destination": pc.LocalAddr().String()},
+	}
+	if service != "" {
+		header.Meta["service"] = service
+	}
+	stream.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	err = writeStreamHeader(stream, sess.streamVersion, header)
+	stream.SetWriteDeadline(time.Time{})
+	if err != nil {
+		t.logf("[Server] Failed to send stream header to client: %v", err)
+		t.stats.addError(publicAddr)
+		return
+	}
+
+	t.stats.addActive(publicAddr, 1)
+	defer t.stats.addActive(publicAddr, -1)
+	idle := time.Duration(t.cfg.UDPIdleTimeoutMs) * time.Millisecond
+	timer := time.AfterFunc(idle, shut)
+	defer timer.Stop()
+
+	sh := t.shaper(publicAddr, peer.String())
+	defer sh.release()
+	countIn, countOut := t.stats.countIn(publicAddr), t.stats.countOut(publicAddr)
+	go func() {
+		defer shut()
+		for {
+			data, err := readDatagram(stream)
+			if err != nil {
+				return
+			}
+			timer.Reset(idle)
+			countOut(len(data))
+			wait(sh.out, len(data))
+			pc.WriteTo(data, peer)
+		}
+	}()
+	for {
+		select {
+		case data := <-p.queue:
+			timer.Reset(idle)
+			wait(sh.in, len(data))
+			if err := writeDatagram(stream, data); err != nil {
+				return
+			}
+			countIn(len(data))
+		case <-closed:
+			return
+		}
+	}
+}
+
+// MODIFIED: This function now creates a robust, optimized http.Server for WSS.
+func (t *Tunnel) listenWSS(ctx context.Context, pool *sessionPool, auth *authenticator) error {
+	cfg := t.cfg
+	mux := http.NewServeMux()
+	mux.HandleFunc(cfg.Path, func(w http.ResponseWriter, r *http.Request) {
+		client := t.bans.clientAddr(r)
+		if t.isBanned(client) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if err := auth.checkWSSHeader(r.Header.Get("X-Auth-Token"), r.URL.Path); err != nil {
+			from := r.RemoteAddr
+			if client != r.RemoteAddr {
+				from = fmt.Sprintf("%q via %s", client, r.RemoteAddr)
+			}
+			t.logf("[Server] WSS Auth failed for %s: %v", from, err)
+			metricAuthFailures.Add(1, t.Name, cfg.Transport)
+			t.authFailed(client, err)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		t.authSucceeded(client)
+		wsConn, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: []string{"tunnel"}})
+		if err != nil {
+			t.logf("[Server] Websocket accept failed: %v", err)
+			return
+		}
+		conn := websocket.NetConn(context.Background(), wsConn, websocket.MessageBinary)
+		go t.handleNewClient(conn, pool)
+	})
+
+	// Create a robust server with timeouts to prevent resource exhaustion from scanners.
+	server := &http.Server{
+		Addr:         cfg.Listen,
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  90 * time.Second, // Crucial for cleaning up stalled connections.
+		ErrorLog:     log.New(log.Writer(), "["+t.Name+"] ", log.LstdFlags),
+	}
+	if cfg.ClientCA != "" {
+		tlsConfig, err := serverTLSConfig(cfg)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = tlsConfig
+	}
+	stop := context.AfterFunc(ctx, func() { server.Close() })
+	defer stop()
+
+	t.logf("[Server] ✅ Listening for WSS tunnel on %s", cfg.Listen)
+	if err := server.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("HTTPS server failed: %w", err)
+	}
+	return nil
+}
+
+func (t *Tunnel) listenTCPMux(ctx context.Context, pool *sessionPool, auth *authenticator) error {
+	listener, err := net.Listen("tcp", t.cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("raw TCP listener failed on %s: %w", t.cfg.Listen, err)
+	}
+	defer listener.Close()
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+	if t.cfg.Transport == "tcpmux+tls" {
+		tlsConfig, err := serverTLSConfig(t.cfg)
+		if err != nil {
+			return err
+		}
+		tlsConfig.MinVersion = tls.VersionTLS13
+		listener = tls.NewListener(listener, tlsConfig)
+		t.logf("[Server] ✅ Listening for TLS TCP Mux tunnel on %s (client certs required: %v)", t.cfg.Listen, t.cfg.ClientCA != "")
+	} else {
+		t.logf("[Server] ✅ Listening for raw TCP Mux tunnel on %s", t.cfg.Listen)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			t.logf("[Server] Raw TCP accept error: %v", err)
+			continue
+		}
+		if t.isBanned(conn.RemoteAddr().String()) {
+			conn.Close()
+			continue
+		}
+		go func(c net.Conn) {
+			c.SetDeadline(time.Now().Add(10 * time.Second))
+			err := auth.serverHandshake(c)
+			c.SetDeadline(time.Time{})
+			if err != nil {
+				t.logf("[Server] Auth failed for %s: %v", c.RemoteAddr(), err)
+				metricAuthFailures.Add(1, t.Name, t.cfg.Transport)
+				t.authFailed(c.RemoteAddr().String(), err)
+				c.Close()
+				return
+			}
+			t.authSucceeded(c.RemoteAddr().String())
+			t.handleNewClient(c, pool)
+		}(conn)
+	}
+}
+
+func (t *Tunnel) listenQUIC(ctx context.Context, pool *sessionPool, auth *authenticator) error {
+	tlsConfig, err := serverTLSConfig(t.cfg)
+	if err != nil {
+		return err
+	}
+	tlsConfig.NextProtos = []string{quicALPN}
+	listener, err := quic.ListenAddr(t.cfg.Listen, tlsConfig, newQUICConfig())
+	if err != nil {
+		return fmt.Errorf("QUIC listener failed on %s: %w", t.cfg.Listen, err)
+	}
+	defer listener.Close()
+	t.logf("[Server] ✅ Listening for QUIC tunnel on %s", t.cfg.Listen)
+	for {
+		conn, err := listener.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			t.logf("[Server] QUIC accept error: %v", err)
+			continue
+		}
+		if t.isBanned(conn.RemoteAddr().String()) {
+			conn.CloseWithError(1, "banned")
+			continue
+		}
+		go func(conn *quic.Conn) {
+			// The first stream a client opens carries the auth handshake;
+			// the connection only joins the pool once it checks out.
+			ctx, cancel := context.WithTimeout(conn.Context(), 10*time.Second)
+			authStream, err := conn.AcceptStream(ctx)
+			cancel()
+			if err != nil {
+				t.logf("[Server] No QUIC auth stream from %s: %v", conn.RemoteAddr(), err)
+				conn.CloseWithError(1, "auth timeout")
+				return
+			}
+			authStream.SetDeadline(time.Now().Add(10 * time.Second))
+			err = auth.serverHandshake(authStream)
+			if err != nil {
+				t.logf("[Server] QUIC Auth failed for %s: %v", conn.RemoteAddr(), err)
+				metricAuthFailures.Add(1, t.Name, t.cfg.Transport)
+				t.authFailed(conn.RemoteAddr().String(), err)
+				conn.CloseWithError(1, "auth failed")
+				return
+			}
+			t.authSucceeded(conn.RemoteAddr().String())
+			authStream.Close()
+			t.logf("[Server] 🤝 Authenticated QUIC client connected from %s", conn.RemoteAddr())
+			t.serveSession(&quicSession{conn: conn}, pool)
+		}(conn)
+	}
+}
+
+const quicALPN = "phantom-quic"
+
+// serverTLSConfig loads the tunnel certificate and, when client_ca is set,
+// demands a client certificate signed by it.
+func serverTLSConfig(cfg *Config) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if cfg.ClientCA != "" {
+		pemData, err := os.ReadFile(cfg.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("client_ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("client_ca: no certificates found in %s", cfg.ClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// peerCertName returns the common name of a verified client certificate.
+func peerCertName(conn net.Conn) string {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := tc.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
+
+func newQUICConfig() *quic.Config {
+	return &quic.Config{
+		KeepAlivePeriod:        30 * time.Second,
+		MaxIdleTimeout:         90 * time.Second,
+		MaxIncomingStreams:     1 << 16,
+		MaxStreamReceiveWindow: 2 * 1024 * 1024,
+	}
+}
+
+func (t *Tunnel) handleNewClient(conn net.Conn, pool *sessionPool) {
+	if name := peerCertName(conn); name != "" {
+		t.logf("[Server] 🤝 Authenticated client %q connected from %s", name, conn.RemoteAddr())
+	} else {
+		t.logf("[Server] 🤝 Authenticated client connected from %s", conn.RemoteAddr())
+	}
+	session, err := yamux.Server(conn, newYamuxConfig())
+	if err != nil {
+		t.logf("[Server] Yamux server creation failed for %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	t.serveSession(&yamuxSession{session}, pool)
+}
+
+// serveSession keeps an authenticated session in the pool until it closes.
+func (t *Tunnel) serveSession(ms muxSession, pool *sessionPool) {
+	session := t.acceptHello(ms)
+	if !pool.Add(session) {
+		session.Close()
+		return
+	}
+	clients := pool.Len()
+	if len(session.services) > 0 {
+		t.logf("[Server] ✅ Client session is now active (%d connected), offering %s.", clients, strings.Join(session.services, ", "))
+	} else {
+		t.logf("[Server] ✅ Client session is now active (%d connected).", clients)
+	}
+	t.stats.setClients(clients)
+	t.warnUnservedPorts(pool)
+	if session.control != nil {
+		go t.serveControl(session)
+		go t.acceptForwards(session)
+	}
+	<-session.CloseChan()
+	if session.control != nil {
+		session.control.Close()
+	}
+	pool.Remove(session)
+	clients = pool.Len()
+	t.logf("[Server] 🔌 Client session from %s has closed (%d remaining).", session.RemoteAddr(), clients)
+	t.stats.setClients(clients)
+	t.warnUnservedPorts(pool)
+}
+
+// serveControl answers a client's requests on its control stream until the
+// stream ends, then closes the ports only that client was holding.
+func (t *Tunnel) serveControl(cs *clientSession) {
+	defer t.releasePorts(cs)
+	for {
+		msg, err := readControl(cs.control)
+		if err != nil {
+			return
+		}
+		reply := &controlMessage{Type: "error", Service: msg.Service, Port: msg.Port}
+		switch msg.Type {
+		case "open_port":
+			port, err := t.openDynamicPort(cs, msg.Service, msg.Port)
+			if err != nil {
+				t.logf("[Server] ⛔ Refused port %s for service %q from %s: %v", msg.Port, msg.Service, cs.RemoteAddr(), err)
+				reply.Error = err.Error()
+			} else {
+				reply.Type, reply.Port = "port_opened", port
+			}
+		default:
+			reply.Error = fmt.Sprintf("unknown request %q", msg.Type)
+		}
+		if err := writeControl(cs.control, reply); err != nil {
+			return
+		}
+	}
+}
+
+// openDynamicPort opens a public port for service within the range the
+// client asked for and the tunnel's policy allows. A port already open for
+// the same service is shared rather than refused, so a client that
+// reconnects before its old session timed out gets its port back.
+func (t *Tunnel) openDynamicPort(cs *clientSession, service, request string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	policy := t.cfg.DynamicPorts
+	if len(policy.Allow) == 0 {
+		return "", errors.New("this server does not accept port requests")
+	}
+	if t.runCtx == nil {
+		return "", errors.New("tunnel is stopping")
+	}
+	if !slices.Contains(cs.services, service) {
+		return "", fmt.Errorf("service %q was not advertised in the hello", service)
+	}
+	lo, hi, err := parsePortRange(request)
+	if err != nil {
+		return "", err
+	}
+	for port := lo; port <= hi; port++ {
+		addr := ":" + strconv.Itoa(port)
+		if dp := t.dynamic[addr]; dp != nil && dp.service == service {
+			if !slices.Contains(cs.claims, addr) {
+				dp.sessions++
+				cs.claims = append(cs.claims, addr)
+			}
+			return strconv.Itoa(port), nil
+		}
+	}
+	if policy.MaxPorts > 0 && len(t.dynamic) >= policy.MaxPorts {
+		return "", fmt.Errorf("all %d allowed ports are taken", policy.MaxPorts)
+	}
+	err = fmt.Errorf("port %s is not allowed", request)
+	for port := lo; port <= hi; port++ {
+		addr := ":" + strconv.Itoa(port)
+		if !policy.allows(port) {
+			continue
+		}
+		if t.dynamic[addr] != nil || slices.Contains(t.cfg.publicAddrs(), addr) {
+			err = fmt.Errorf("port %d is already in use", port)
+			continue
+		}
+		ln, lerr := net.Listen("tcp", addr)
+		if lerr != nil {
+			err = lerr
+			continue
+		}
+		ctx, cancel := context.WithCancel(t.runCtx)
+		t.dynamic[addr] = &dynamicPort{service: service, sessions: 1, cancel: cancel}
+		cs.claims = append(cs.claims, addr)
+		t.stats.registerEndpoints([]string{addr})
+		go t.startPublicListener(ctx, ln, addr, dynamicPortIndex, service, t.pool)
+		return strconv.Itoa(port), nil
+	}
+	return "", err
+}
+
+// releasePorts drops a session's claims and closes the dynamic ports no
+// other session holds.
+func (t *Tunnel) releasePorts(cs *clientSession) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, addr := range cs.claims {
+		dp := t.dynamic[addr]
+		if dp == nil {
+			continue
+		}
+		if dp.sessions--; dp.sessions > 0 {
+			continue
+		}
+		dp.cancel()
+		delete(t.dynamic, addr)
+		t.stats.removeEndpoint(addr)
+		t.logf("[Server] Closed public port %s for service %q", addr, dp.service)
+	}
+	cs.claims = nil
+}
+
+// warnUnservedPorts logs every named public port that no connected client
+// offers. Connections to such ports are refused until one does.
+func (t *Tunnel) warnUnservedPorts(pool *sessionPool) {
+	if pool.Len() == 0 {
+		return
+	}
+	t.mu.Lock()
+	ports := append([]string(nil), t.cfg.PublicPorts...)
+	t.mu.Unlock()
+	for _, entry := range ports {
+		if service, _ := splitService(entry); service != "" && !pool.offers(service) {
+			t.logf("[Server] ⚠️ No connected client offers service %q, connections to %s will be refused", service, publicAddr(entry))
+		}
+	}
+}
+
+// =========================================================================
+//                             CLIENT LOGIC
+// =========================================================================
+
+func (t *Tunnel) runClient(ctx context.Context) error {
+	cfg := t.cfg
+	localAddrList := cfg.LocalTargets
+	if (len(localAddrList) == 0 || localAddrList[0] == "") && len(cfg.Forwards) == 0 {
+		return errors.New("no local addresses provided to forward to")
+	}
+	if len(localAddrList) > 0 {
+		t.logf("[Client] Forwarding to %d local addresses: %v", len(localAddrList), localAddrList)
+	}
+	t.stats.registerEndpoints(cfg.endpoints())
+	defer t.setForwardSession(nil)
+	t.runForwards(ctx)
+
+	endpoints := cfg.serverEndpoints()
+	tlsConfigs := make([]*tls.Config, len(endpoints))
+	for i, ep := range endpoints {
+		tlsConfig, err := clientTLSConfig(cfg, ep)
+		if err != nil {
+			return err
+		}
+		tlsConfigs[i] = tlsConfig
+		if usesTLS(ep.Transport) && cfg.PinSHA256 == "" && ep.PinSHA256 == "" && cfg.CAFile == "" && !cfg.VerifyTLS {
+			t.logf("[Client] ⚠️ Certificate of %s is NOT verified. Set pin_sha256, ca_file or verify_tls.", ep.Address)
+		}
+	}
+	dial := func(i int) (muxSession, error) {
+		t.logf("[Client] ... Attempting connection to %s using %s", endpoints[i].Address, endpoints[i].Transport)
+		return t.dialServer(ctx, endpoints[i], tlsConfigs[i])
+	}
+
+	bo := newBackoff(cfg.Reconnect)
+	established := false
+	for ctx.Err() == nil {
+		t.stats.setConnected(false)
+
+		// Walk the endpoints from the most preferred one and back off only
+		// once every endpoint has failed.
+		var session muxSession
+		index := -1
+		for i := range endpoints {
+			s, err := dial(i)
+			if err == nil {
+				session, index = s, i
+				break
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			t.logf("[Client] ❌ Connection to %s failed: %v", endpoints[i].Address, err)
+		}
+		if session == nil {
+			delay := bo.next()
+			t.logf("[Client] All %d servers failed. Retrying in %s...", len(endpoints), delay.Round(100*time.Millisecond))
+			select {
+			case <-ctx.Done():
+			case <-time.After(delay):
+			}
+			continue
+		}
+
+		if established {
+			metricReconnects.Add(1, t.Name)
+		}
+		established = true
+		up := time.Now()
+		t.serveServerSession(ctx, session, index, dial)
+
+		// A server that takes the handshake and then drops the session
+		// straight away is backed off from like one that refuses it.
+		if time.Since(up) >= stableSession {
+			bo.reset()
+		} else if ctx.Err() == nil {
+			delay := bo.next()
+			t.logf("[Client] Session ended after %s. Retrying in %s...", time.Since(up).Round(100*time.Millisecond), delay.Round(100*time.Millisecond))
+			select {
+			case <-ctx.Done():
+			case <-time.After(delay):
+			}
+		}
+	}
+	return nil
+}
+
+// serveServerSession handles streams from the server until the session
+// ends. While connected to a fallback endpoint it keeps probing the more
+// preferred ones in the background and moves over as soon as one of them
+// answers; the old session is kept until its streams finish.
+func (t *Tunnel) serveServerSession(ctx context.Context, session muxSession, index int, dial func(int) (muxSession, error)) {
+	endpoints := t.cfg.serverEndpoints()
+	failback := time.NewTicker(time.Duration(t.cfg.Reconnect.FailbackIntervalMs) * time.Millisecond)
+	defer failback.Stop()
+
+	// probe carries the result of the failback probe in flight, if any.
+	type probeResult struct {
+		session muxSession
+		index   int
+	}
+	var probe chan probeResult
+	defer func() {
+		if probe != nil {
+			go func(probe chan probeResult) {
+				if r := <-probe; r.session != nil {
+					r.session.Close()
+				}
+			}(probe)
+		}
+	}()
+
+	for {
+		t.logf("[Client] ✅ Tunnel connection established with %s!", endpoints[index].Address)
+		t.stats.setConnected(true)
+		t.stats.setServer(endpoints[index].Address)
+		if t.readyFile != "" {
+			if f, err := os.Create(t.readyFile); err == nil {
+				f.Close()
+			}
+		}
+		version, features, control := sendHello(session, slices.Sorted(maps.Keys(t.cfg.services())), t.cfg.features())
+		if slices.Contains(features, "forward") {
+			t.setForwardSession(session)
+		} else {
+			t.setForwardSession(nil)
+			if len(t.cfg.Forwards) > 0 {
+				t.logf("[Client] ⚠️ Server %s does not take forwards", endpoints[index].Address)
+			}
+		}
+		if control == nil {
+			t.logf("[Client] Server did not answer the hello, using stream header version %d", version)
+		}
+		go t.acceptStreams(ctx, session, version)
+		if len(t.cfg.RemotePorts) > 0 {
+			go t.requestPorts(control, version)
+		}
+
+		for switched := false; !switched; {
+			select {
+			case <-ctx.Done():
+				session.Close()
+				return
+			case <-session.CloseChan():
+				if ctx.Err() == nil {
+					t.logf("[Client] ... Session with %s terminated. Reconnecting...", endpoints[index].Address)
+				}
+				return
+			case <-failback.C:
+				if probe != nil || index == 0 {
+					continue
+				}
+				probe = make(chan probeResult, 1)
+				go func(probe chan<- probeResult, index int) {
+					for i := 0; i < index; i++ {
+						if s, err := dial(i); err == nil {
+							probe <- probeResult{s, i}
+							return
+						}
+					}
+					probe <- probeResult{nil, -1}
+				}(probe, index)
+			case r := <-probe:
+				probe = nil
+				if r.session == nil {
+					continue
+				}
+				t.logf("[Client] 🔁 Preferred server %s is healthy again, moving back from %s", endpoints[r.index].Address, endpoints[index].Address)
+				metricReconnects.Add(1, t.Name)
+				go drainSession(session)
+				session, index, switched = r.session, r.index, true
+			}
+		}
+	}
+}
+
+// requestPorts asks the server to open the public ports in remote_ports.
+func (t *Tunnel) requestPorts(control net.Conn, version int) {
+	if control == nil || version < streamVersion2 {
+		t.logf("[Client] ⚠️ Server does not take port requests, remote_ports are ignored")
+		return
+	}
+	for _, entry := range t.cfg.RemotePorts {
+		service, port := splitService(entry)
+		control.SetDeadline(time.Now().Add(helloTimeout))
+		err := writeControl(control, &controlMessage{Type: "open_port", Service: service, Port: port})
+		var reply *controlMessage
+		if err == nil {
+			reply, err = readControl(control)
+		}
+		control.SetDeadline(time.Time{})
+		switch {
+		case err != nil:
+			t.logf("[Client] ❌ Server did not answer the request for port %s: %v", port, err)
+			return
+		case reply.Type != "port_opened":
+			t.logf("[Client] ❌ Server refused port %s for service %s: %s", port, service, reply.Error)
+		default:
+			t.logf("[Client] 📡 Server opened public port %s for service %s", reply.Port, service)
+		}
+	}
+}
+
+func (t *Tunnel) acceptStreams(ctx context.Context, session muxSession, version int) {
+	stop := context.AfterFunc(ctx, func() { session.Close() })
+	defer stop()
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go t.handleStream(stream, version)
+	}
+}
+
+// drainSession closes a session once it carries no more streams, or after
+// a minute at the latest.
+func drainSession(session muxSession) {
+	deadline := time.Now().Add(time.Minute)
+	for session.NumStreams() > 0 && time.Now().Before(deadline) && !session.IsClosed() {
+		time.Sleep(time.Second)
+	}
+	session.Close()
+}
+
+// dialServer connects and authenticates to one server endpoint.
+func (t *Tunnel) dialServer(ctx context.Context, ep ServerEndpoint, tlsConfig *tls.Config) (muxSession, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+	authToken := t.cfg.Token
+
+	var conn net.Conn
+	var err error
+	switch ep.Transport {
+	case "wss":
+		header := http.Header{}
+		if authToken != "" {
+			header.Set("X-Auth-Token", wssAuthHeader(authToken, wssPath(ep.Address)))
+		}
+		wsConn, _, dialErr := websocket.Dial(dialCtx, ep.Address, &websocket.DialOptions{
+			Subprotocols: []string{"tunnel"},
+			HTTPClient:   &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+			HTTPHeader:   header,
+		})
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		conn = websocket.NetConn(context.Background(), wsConn, websocket.MessageBinary)
+	case "tcpmux", "tcpmux+tls":
+		if ep.Transport == "tcpmux+tls" {
+			d := tls.Dialer{Config: tlsConfig}
+			conn, err = d.DialContext(dialCtx, "tcp", ep.Address)
+		} else {
+			var d net.Dialer
+			conn, err = d.DialContext(dialCtx, "tcp", ep.Address)
+		}
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if err := clientHandshake(conn, authToken); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+	case "quic":
+		return dialQUIC(dialCtx, ep.Address, tlsConfig, authToken)
+	default:
+		return nil, fmt.Errorf("unknown client tunnel type: %s", ep.Transport)
+	}
+
+	session, err := yamux.Client(conn, newYamuxConfig())
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("multiplexing failed: %w", err)
+	}
+	return &yamuxSession{session}, nil
+}
+
+// stableSession is how long a session has to last before the reconnect
+// backoff starts over.
+const stableSession = 30 * time.Second
+
+// backoff spaces out reconnect attempts: the delay doubles after every
+// failed round up to the maximum, and a random part keeps many clients
+// from retrying in lockstep.
+type backoff struct {
+	min, max time.Duration
+	attempt  int
+}
+
+func newBackoff(rc ReconnectConfig) *backoff {
+	return &backoff{
+		min: time.Duration(rc.MinDelayMs) * time.Millisecond,
+		max: time.Duration(rc.MaxDelayMs) * time.Millisecond,
+	}
+}
+
+// next returns a delay between half and all of the current step.
+func (b *backoff) next() time.Duration {
+	step := b.min << min(b.attempt, 30)
+	if step > b.max || step <= 0 {
+		step = b.max
+	} else {
+		b.attempt++
+	}
+	half := step / 2
+	jitter, _ := rand.Int(rand.Reader, big.NewInt(int64(half)+1))
+	return half + time.Duration(jitter.Int64())
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+func (t *Tunnel) handleStream(s net.Conn, version int) {
+	defer s.Close()
+	localAddrList := t.cfg.LocalTargets
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header, err := readStreamHeader(s, version)
+	s.SetReadDeadline(time.Time{})
+	if err != nil {
+		t.logf("[Client] Failed to read stream header: %v", err)
+		return
+	}
+	if header.Meta["dial"] != "" {
+		t.serveDial(s, header, "[Client]")
+		return
+	}
+	portIndex := header.Target
+
+	var targetAddr string
+	service := header.Meta["service"]
+	if service != "" {
+		addr, ok := t.cfg.services()[service]
+		if !ok {
+			t.logf("[Client] Received stream for unknown service %q.", service)
+			return
+		}
+		targetAddr = addr
+		t.logf("[Client] New stream for service %s -> %s", service, targetAddr)
+	} else {
+		if portIndex < 0 || portIndex >= len(localAddrList) {
+			t.logf("[Client] Received invalid port index %d. Max is %d.", portIndex, len(localAddrList)-1)
+			return
+		}
+		_, targetAddr = splitService(localAddrList[portIndex])
+		t.logf("[Client] New stream for index %d -> %s", portIndex, targetAddr)
+	}
+	if err := t.quotaRefusal(targetAddr); err != nil {
+		t.logf("[Client] ⛔ Refused stream for %s: %v", targetAddr, err)
+		t.countRefusal(targetAddr, err)
+		return
+	}
+
+	if header.Meta["network"] == "udp" {
+		t.forwardUDP(s, targetAddr, header.Source)
+		return
+	}
+
+	dialed := time.Now()
+	localConn, err := net.Dial("tcp", targetAddr)
+	if err != nil {
+		t.logf("[Client] Failed to dial local service '%s': %v", targetAddr, err)
+		t.stats.addError(targetAddr)
+		return
+	}
+	defer localConn.Close()
+	metricStreamOpen.Observe(time.Since(dialed).Seconds(), t.Name, targetAddr)
+
+	if v := t.cfg.proxyVersion(service, targetAddr); v != 0 {
+		// Servers that send version 1 stream headers give no source, which
+		// becomes an UNKNOWN/LOCAL header.
+		if _, err := localConn.Write(proxyHeader(v, header.Source, header.Meta["destination"])); err != nil {
+			t.logf("[Client] Failed to send PROXY header to '%s': %v", targetAddr, err)
+			t.stats.addError(targetAddr)
+			return
+		}
+	}
+
+	t.stats.addActive(targetAddr, 1)
+	defer t.stats.addActive(targetAddr, -1)
+
+	sh := t.shaper(targetAddr, header.Source)
+	defer sh.release()
+	c := &shapedConn{Conn: localConn, s: sh}
+
+	go pipeCount(c, s, t.stats.countOut(targetAddr), 0, 0)
+	pipeCount(s, c, t.stats.countIn(targetAddr), t.cfg.Fragment.Size, t.cfg.Fragment.DelayMs)
+}
+
+// forwardUDP relays the datagrams of one remote UDP peer between a stream
+// and the local target until either side has been idle for
+// udp_idle_timeout_ms.
+func (t *Tunnel) forwardUDP(s net.Conn, targetAddr, source string) {
+	conn, err := net.Dial("udp", targetAddr)
+	if err != nil {
+		t.logf("[Client] Failed to dial local UDP service '%s': %v", targetAddr, err)
+		t.stats.addError(targetAddr)
+		return
+	}
+	shut := sync.OnceFunc(func() {
+		s.Close()
+		conn.Close()
+	})
+	defer shut()
+	idle := time.Duration(t.cfg.UDPIdleTimeoutMs) * time.Millisecond
+	timer := time.AfterFunc(idle, shut)
+	defer timer.Stop()
+
+	t.stats.addActive(targetAddr, 1)
+	defer t.stats.addActive(targetAddr, -1)
+	sh := t.shaper(targetAddr, source)
+	defer sh.release()
+
+	countOut := t.stats.countOut(targetAddr)
+	go func() {
+		defer shut()
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			timer.Reset(idle)
+			wait(sh.out, n)
+			if err := writeDatagram(s, buf[:n]); err != nil {
+				return
+			}
+			countOut(n)
+		}
+	}()
+	countIn := t.stats.countIn(targetAddr)
+	for {
+		data, err := readDatagram(s)
+		if err != nil {
+			return
+		}
+		timer.Reset(idle)
+		wait(sh.in, len(data))
+		conn.Write(data)
+		countIn(len(data))
+	}
+}
+
+// clientTLSConfig builds the TLS settings used to dial a wss or quic
+// server. Verification is done by hand in VerifyConnection so a pin, a
+// custom CA and the system roots can be combined freely.
+func clientTLSConfig(cfg *Config, ep ServerEndpoint) (*tls.Config, error) {
+	pinSHA256, serverName := ep.PinSHA256, ep.ServerName
+	if pinSHA256 == "" {
+		pinSHA256 = cfg.PinSHA256
+	}
+	if serverName == "" {
+		serverName = cfg.ServerName
+	}
+	var pin []byte
+	if pinSHA256 != "" {
+		var err error
+		if pin, err = parseFingerprint(pinSHA256); err != nil {
+			return nil, fmt.Errorf("pin_sha256: %w", err)
+		}
+	}
+	var roots *x509.CertPool
+	if cfg.CAFile != "" {
+		pemData, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("ca_file: %w", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("ca_file: no certificates found in %s", cfg.CAFile)
+		}
+	}
+	verifyChain := roots != nil || cfg.VerifyTLS
+	host := serverName
+	if host == "" {
+		host = serverHostname(ep.Address)
+	}
+	var certs []tls.Certificate
+	if cfg.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("client_cert: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	minVersion := uint16(tls.VersionTLS12)
+	if ep.Transport == "tcpmux+tls" {
+		minVersion = tls.VersionTLS13
+	}
+
+	return &tls.Config{
+		ServerName:         serverName,
+		Certificates:       certs,
+		MinVersion:         minVersion,
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server sent no certificate")
+			}
+			leaf := cs.PeerCertificates[0]
+			if verifyChain {
+				intermediates := x509.NewCertPool()
+				for _, c := range cs.PeerCertificates[1:] {
+					intermediates.AddCert(c)
+				}
+				if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: host, Intermediates: intermediates}); err != nil {
+					return err
+				}
+			}
+			if pin != nil {
+				sum := sha256.Sum256(leaf.Raw)
+				if !hmac.Equal(sum[:], pin) {
+					return fmt.Errorf("server certificate fingerprint %s does not match the pinned one", formatFingerprint(sum[:]))
+				}
+			}
+			return nil
+		},
+	}, nil
+}
+
+func serverHostname(server string) string {
+	if u, err := url.Parse(server); err == nil && u.Host != "" {
+		return u.Hostname()
+	}
+	if host, _, err := net.SplitHostPort(server); err == nil {
+		return host
+	}
+	return server
+}
+
+// parseFingerprint accepts a SHA-256 fingerprint as plain hex or in the
+// colon-separated form printed by setup and by openssl.
+func parseFingerprint(s string) ([]byte, error) {
+	s = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(s), ":", ""))
+	s = strings.TrimPrefix(s, "sha256/")
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != sha256.Size {
+		return nil, errors.New("expected a 64-character hex SHA-256 fingerprint")
+	}
+	return b, nil
+}
+
+func formatFingerprint(sum []byte) string {
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+func certFingerprint(certFile string) (string, error) {
+	pemData, err := os.ReadFile(certFile)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return "", fmt.Errorf("no PEM data in %s", certFile)
+	}
+	sum := sha256.Sum256(block.Bytes)
+	return formatFingerprint(sum[:]), nil
+}
+
+// wssPath returns the URL path the WSS auth header is bound to.
+func wssPath(serverURL string) string {
+	u, err := url.Parse(serverURL)
+	if err != nil || u.Path == "" {
+		return "/"
+	}
+	return u.Path
+}
+
+func dialQUIC(ctx context.Context, serverAddr string, tlsConfig *tls.Config, authToken string) (muxSession, error) {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{quicALPN}
+	conn, err := quic.DialAddr(ctx, serverAddr, tlsConfig, newQUICConfig())
+	if err != nil {
+		return nil, err
+	}
+	authStream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(1, "auth failed")
+		return nil, err
+	}
+	authStream.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := clientHandshake(authStream, authToken); err != nil {
+		conn.CloseWithError(1, "auth failed")
+		return nil, fmt.Errorf("QUIC auth: %w", err)
+	}
+	authStream.Close()
+	return &quicSession{conn: conn}, nil
 }
 
 // ... (The rest of the file remains unchanged) ...
-func startWebDashboard(port string) {
+// =========================================================================
+//                             FORWARD MODE
+// =========================================================================
+
+// In forward mode the client listens on local ports and carries each
+// connection to the server, which dials the destination on its side. The
+// client opens the stream and writes a version 2 header whose "dial" entry
+// names the destination; the dialing side answers with a "dial_result"
+// control message before any data flows. Proxy exits use the same request
+// in the other direction.
+
+// errNotAllowed marks a destination refused by the allow-list.
+var errNotAllowed = errors.New("not allowed")
+
+// destRule is one entry of a destination allow-list.
+type destRule struct {
+	host   string       // "*", a hostname, or "*.domain"
+	prefix netip.Prefix // set for IP and CIDR entries
+	lo, hi int
+}
+
+// parseDestRules parses allow-list entries: a host, IP or CIDR with an
+// optional port or port range, such as "db.internal:5432", "10.0.0.0/8",
+// "*.example.com:443" or "[fd00::/8]:1000-2000".
+func parseDestRules(entries []string) ([]destRule, error) {
+	var rules []destRule
+	for _, entry := range entries {
+		r := destRule{host: entry, lo: 1, hi: 65535}
+		if host, ports, err := net.SplitHostPort(entry); err == nil {
+			if r.lo, r.hi, err = parsePortRange(ports); err != nil {
+				return nil, fmt.Errorf("%q: %v", entry, err)
+			}
+			r.host = host
+		}
+		if p, err := netip.ParsePrefix(r.host); err == nil {
+			r.prefix = p.Masked()
+		} else if ip, err := netip.ParseAddr(r.host); err == nil {
+			r.prefix = netip.PrefixFrom(ip, ip.BitLen())
+		} else if r.host == "" || strings.ContainsAny(r.host, "/[]") {
+			return nil, fmt.Errorf("%q: invalid host", entry)
+		}
+		r.host = strings.ToLower(r.host)
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// destAllowed reports whether a connection to ip:port, asked for by the
+// name host, matches any rule.
+func destAllowed(rules []destRule, host string, ip netip.Addr, port int) bool {
+	host = strings.ToLower(host)
+	for _, r := range rules {
+		if port < r.lo || port > r.hi {
+			continue
+		}
+		switch {
+		case r.prefix.IsValid():
+			if r.prefix.Contains(ip.Unmap()) {
+				return true
+			}
+		case r.host == "*" || r.host == host:
+			return true
+		case strings.HasPrefix(r.host, "*.") && strings.HasSuffix(host, r.host[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+// dialAllowed resolves dest and dials the first address the rules allow.
+// The checked address is the one dialled, so a name cannot be re-resolved
+// to somewhere else between the check and the connection.
+func dialAllowed(ctx context.Context, rules []destRule, dest string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(dest)
+	if err != nil || !validPort(portStr) {
+		return nil, fmt.Errorf("invalid destination %q", dest)
+	}
+	port, _ := strconv.Atoi(portStr)
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	err = fmt.Errorf("destination %s is %w", dest, errNotAllowed)
+	var d net.Dialer
+	for _, ip := range ips {
+		if !destAllowed(rules, host, ip, port) {
+			continue
+		}
+		conn, derr := d.DialContext(ctx, "tcp", netip.AddrPortFrom(ip.Unmap(), uint16(port)).String())
+		if derr == nil {
+			return conn, nil
+		}
+		err = derr
+	}
+	return nil, err
+}
+
+// acceptForwards takes the streams a client opens after its hello and
+// dials their destinations for it.
+func (t *Tunnel) acceptForwards(cs *clientSession) {
+	for {
+		stream, err := cs.AcceptStream()
+		if err != nil {
+			return
+		}
+		go t.handleForward(stream, cs)
+	}
+}
+
+func (t *Tunnel) handleForward(stream net.Conn, cs *clientSession) {
+	defer stream.Close()
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header, err := readStreamHeader(stream, streamVersion2)
+	stream.SetReadDeadline(time.Time{})
+	if err != nil {
+		t.logf("[Server] Failed to read forward request from %s: %v", cs.RemoteAddr(), err)
+		return
+	}
+	t.serveDial(stream, header, "[Server]")
+}
+
+// serveDial dials the destination a peer asked for, if allow_destinations
+// permits it, answers with a "dial_result" and relays the connection.
+func (t *Tunnel) serveDial(stream net.Conn, header *streamHeader, side string) {
+	dest := header.Meta["dial"]
+	rules, _ := parseDestRules(t.cfg.AllowDestinations)
+	var conn net.Conn
+	var err error
+	if len(rules) == 0 {
+		err = fmt.Errorf("dialing out is %w here (allow_destinations is empty)", errNotAllowed)
+	} else if err = t.quotaRefusal(forwardEndpoint); err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		conn, err = dialAllowed(ctx, rules, dest)
+		cancel()
+	}
+	reply := &controlMessage{Type: "dial_result"}
+	if err != nil {
+		t.logf("%s ⛔ Refused to dial %s for %s: %v", side, dest, header.Source, err)
+		t.countRefusal(forwardEndpoint, err)
+		reply.Error, reply.Refused = err.Error(), errors.Is(err, errNotAllowed)
+	}
+	stream.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	werr := writeControl(stream, reply)
+	stream.SetWriteDeadline(time.Time{})
+	if err != nil || werr != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+	defer conn.Close()
+
+	t.stats.addActive(forwardEndpoint, 1)
+	defer t.stats.addActive(forwardEndpoint, -1)
+	sh := t.shaper(forwardEndpoint, header.Source)
+	defer sh.release()
+	c := &shapedConn{Conn: conn, s: sh}
+	go pipeCount(c, stream, t.stats.countIn(forwardEndpoint), 0, 0)
+	pipeCount(stream, c, t.stats.countOut(forwardEndpoint), t.cfg.Fragment.Size, t.cfg.Fragment.DelayMs)
+}
+
+// forwardEndpoint is the stats endpoint connections dialled for the peer
+// are accounted under.
+const forwardEndpoint = "forwards"
+
+// runForwards listens on the client's forward ports for as long as the
+// tunnel runs, whether or not a server is connected.
+func (t *Tunnel) runForwards(ctx context.Context) {
+	for _, f := range t.cfg.Forwards {
+		ln, err := net.Listen("tcp", f.Listen)
+		if err != nil {
+			t.logf("[Client] ❌ Could not listen for forward %s -> %s: %v", f.Listen, f.Destination, err)
+			continue
+		}
+		t.logf("[Client] ✅ Forwarding %s -> %s through the server", f.Listen, f.Destination)
+		go func(ln net.Listener, f ForwardConfig) {
+			defer ln.Close()
+			stop := context.AfterFunc(ctx, func() { ln.Close() })
+			defer stop()
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					continue
+				}
+				go t.forwardConn(conn, f)
+			}
+		}(ln, f)
+	}
+}
+
+// setForwardSession records the server session forwards are carried on,
+// or nil while there is none that takes them.
+func (t *Tunnel) setForwardSession(s muxSession) {
+	t.mu.Lock()
+	t.forwardSess = s
+	t.mu.Unlock()
+}
+
+func (t *Tunnel) forwardConn(conn net.Conn, f ForwardConfig) {
+	defer conn.Close()
+	if err := t.quotaRefusal(f.Listen); err != nil {
+		t.logf("[Client] ⛔ Refused forward %s -> %s: %v", f.Listen, f.Destination, err)
+		t.countRefusal(f.Listen, err)
+		return
+	}
+	t.mu.Lock()
+	sess := t.forwardSess
+	t.mu.Unlock()
+	if sess == nil || sess.IsClosed() {
+		t.logf("[Client] ⛔ Refused forward %s -> %s: not connected to a server that takes forwards", f.Listen, f.Destination)
+		t.stats.addError(f.Listen)
+		return
+	}
+	stream, err := sess.OpenStream()
+	if err != nil {
+		t.stats.addError(f.Listen)
+		return
+	}
+	defer stream.Close()
+
+	header := &streamHeader{Source: conn.RemoteAddr().String(), Meta: map[string]string{"dial": f.Destination}}
+	stream.SetDeadline(time.Now().Add(15 * time.Second))
+	err = writeStreamHeader(stream, streamVersion2, header)
+	var reply *controlMessage
+	if err == nil {
+		reply, err = readControl(stream)
+	}
+	stream.SetDeadline(time.Time{})
+	if err == nil && reply.Error != "" {
+		err = errors.New(reply.Error)
+	}
+	if err != nil {
+		t.logf("[Client] ❌ Forward %s -> %s failed: %v", f.Listen, f.Destination, err)
+		t.stats.addError(f.Listen)
+		return
+	}
+
+	t.stats.addActive(f.Listen, 1)
+	defer t.stats.addActive(f.Listen, -1)
+	sh := t.shaper(f.Listen, conn.RemoteAddr().String())
+	defer sh.release()
+	c := &shapedConn{Conn: conn, s: sh, visitor: true}
+	go pipeCount(stream, c, t.stats.countIn(f.Listen), t.cfg.Fragment.Size, t.cfg.Fragment.DelayMs)
+	pipeCount(c, stream, t.stats.countOut(f.Listen), 0, 0)
+}
+
+// =========================================================================
+//                             SOCKS AND HTTP PROXY
+// =========================================================================
+
+// A server can expose a SOCKS5 and HTTP CONNECT proxy on one port. Each
+// request is carried to a client that allows proxy exits, and the client
+// resolves and dials the destination, so names resolve on its network.
+
+type proxyResult int
+
+const (
+	proxyOK proxyResult = iota
+	proxyNotAllowed
+	proxyUnreachable
+	proxyUnavailable
+)
+
+// proxyAuth checks proxy credentials against bcrypt hashes. Bcrypt is slow
+// on purpose, so credentials that checked out once are remembered.
+type proxyAuth struct {
+	users    map[string][]byte
+	mu       sync.Mutex
+	verified map[[32]byte]bool
+}
+
+func newProxyAuth(users []DashboardUser) *proxyAuth {
+	a := &proxyAuth{users: map[string][]byte{}, verified: map[[32]byte]bool{}}
+	for _, u := range users {
+		a.users[u.Username] = []byte(u.PasswordHash)
+	}
+	return a
+}
+
+func (a *proxyAuth) open() bool {
+	return len(a.users) == 0
+}
+
+func (a *proxyAuth) check(user, pass string) bool {
+	key := sha256.Sum256([]byte(user + "\x00" + pass))
+	a.mu.Lock()
+	ok := a.verified[key]
+	a.mu.Unlock()
+	if ok {
+		return true
+	}
+	hash, known := a.users[user]
+	if !known {
+		hash = dummyHash()
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(pass)) != nil || !known {
+		return false
+	}
+	a.mu.Lock()
+	a.verified[key] = true
+	a.mu.Unlock()
+	return true
+}
+
+func (t *Tunnel) startProxyListener(ctx context.Context, ln net.Listener, pool *sessionPool) {
+	defer ln.Close()
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+	auth := newProxyAuth(t.cfg.Proxy.Users)
+	t.logf("[Server] ✅ Listening for SOCKS5 and HTTP CONNECT on %s", t.cfg.Proxy.Listen)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		go t.handleProxyConn(conn, auth, pool)
+	}
+}
+
+func (t *Tunnel) handleProxyConn(conn net.Conn, auth *proxyAuth, pool *sessionPool) {
+	defer conn.Close()
+	addr := t.cfg.Proxy.Listen
+	release, err := t.admit(addr, conn.RemoteAddr().String())
+	if err != nil {
+		t.logf("[Server] ⛔ Proxy connection from %s refused: %v", conn.RemoteAddr(), err)
+		t.countRefusal(addr, err)
+		return
+	}
+	defer release()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		return
+	}
+	var dest string
+	var respond func(proxyResult) error
+	if first[0] == 5 {
+		dest, respond, err = socksHandshake(br, conn, auth)
+	} else {
+		dest, respond, err = httpConnectHandshake(br, conn, auth)
+	}
+	if err != nil {
+		t.logf("[Server] ⛔ Proxy request from %s refused: %v", conn.RemoteAddr(), err)
+		t.stats.addError(addr)
+		return
+	}
+
+	sess := pool.Get("", "proxy")
+	if sess == nil {
+		t.logf("[Server] ⛔ Proxy request from %s to %s refused: no connected client allows proxy exits", conn.RemoteAddr(), dest)
+		t.stats.addError(addr)
+		respond(proxyUnavailable)
+		return
+	}
+	stream, err := sess.OpenStream()
+	if err != nil {
+		t.stats.addError(addr)
+		respond(proxyUnavailable)
+		return
+	}
+	defer stream.Close()
+
+	header := &streamHeader{Source: conn.RemoteAddr().String(), Meta: map[string]string{"dial": dest, "listener": addr}}
+	stream.SetDeadline(time.Now().Add(15 * time.Second))
+	err = writeStreamHeader(stream, sess.streamVersion, header)
+	var reply *controlMessage
+	if err == nil {
+		reply, err = readControl(stream)
+	}
+	stream.SetDeadline(time.Time{})
+	result := proxyOK
+	switch {
+	case err != nil:
+		result = proxyUnavailable
+	case reply.Refused:
+		result, err = proxyNotAllowed, errors.New(reply.Error)
+	case reply.Error != "":
+		result, err = proxyUnreachable, errors.New(reply.Error)
+	}
+	if err != nil {
+		t.logf("[Server] ⛔ Proxy request from %s to %s failed: %v", conn.RemoteAddr(), dest, err)
+		t.stats.addError(addr)
+		respond(result)
+		return
+	}
+	if err := respond(proxyOK); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	t.stats.addActive(addr, 1)
+	defer t.stats.addActive(addr, -1)
+	sh := t.shaper(addr, conn.RemoteAddr().String())
+	defer sh.release()
+	c := &shapedConn{Conn: &bufferedConn{Conn: conn, r: br}, s: sh, visitor: true}
+	go pipeCount(stream, c, t.stats.countIn(addr), t.cfg.Fragment.Size, t.cfg.Fragment.DelayMs)
+	pipeCount(c, stream, t.stats.countOut(addr), 0, 0)
+}
+
+// socksHandshake runs the SOCKS5 greeting, RFC 1929 username/password
+// auth when users are configured, and reads a CONNECT request.
+func socksHandshake(br *bufio.Reader, w io.Writer, auth *proxyAuth) (string, func(proxyResult) error, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return "", nil, err
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return "", nil, err
+	}
+	method := byte(0x00)
+	if !auth.open() {
+		method = 0x02
+	}
+	if !bytes.Contains(methods, []byte{method}) {
+		w.Write([]byte{5, 0xFF})
+		return "", nil, errors.New("SOCKS client offered no acceptable auth method")
+	}
+	if _, err := w.Write([]byte{5, method}); err != nil {
+		return "", nil, err
+	}
+	if method == 0x02 {
+		readString := func() (string, error) {
+			n, err := br.ReadByte()
+			if err != nil {
+				return "", err
+			}
+			buf := make([]byte, n)
+			_, err = io.ReadFull(br, buf)
+			return string(buf), err
+		}
+		if _, err := br.ReadByte(); err != nil {
+			return "", nil, err
+		}
+		user, err := readString()
+		if err != nil {
+			return "", nil, err
+		}
+		pass, err := readString()
+		if err != nil {
+			return "", nil, err
+		}
+		if !auth.check(user, pass) {
+			w.Write([]byte{1, 1})
+			return "", nil, fmt.Errorf("bad SOCKS credentials for user %q", user)
+		}
+		if _, err := w.Write([]byte{1, 0}); err != nil {
+			return "", nil, err
+		}
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(br, req); err != nil {
+		return "", nil, err
+	}
+	reply := func(code byte) error {
+		_, err := w.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0})
+		return err
+	}
+	var host string
+	switch req[3] {
+	case 1, 4:
+		ip := make([]byte, 4)
+		if req[3] == 4 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return "", nil, err
+		}
+		addr, _ := netip.AddrFromSlice(ip)
+		host = addr.String()
+	case 3:
+		n, err := br.ReadByte()
+		if err != nil {
+			return "", nil, err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return "", nil, err
+		}
+		host = string(name)
+	default:
+		reply(0x08)
+		return "", nil, fmt.Errorf("unsupported SOCKS address type %d", req[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(br, port); err != nil {
+		return "", nil, err
+	}
+	if req[1] != 1 {
+		reply(0x07)
+		return "", nil, fmt.Errorf("unsupported SOCKS command %d (only CONNECT)", req[1])
+	}
+	dest := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	return dest, func(r proxyResult) error {
+		return reply(map[proxyResult]byte{proxyOK: 0x00, proxyNotAllowed: 0x02, proxyUnreachable: 0x04, proxyUnavailable: 0x01}[r])
+	}, nil
+}
+
+// httpConnectHandshake reads an HTTP CONNECT request, checking
+// Proxy-Authorization when users are configured.
+func httpConnectHandshake(br *bufio.Reader, w io.Writer, auth *proxyAuth) (string, func(proxyResult) error, error) {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return "", nil, err
+	}
+	status := func(code int, extra string) error {
+		_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\n\r\n", code, http.StatusText(code), extra)
+		return err
+	}
+	if req.Method != http.MethodConnect {
+		status(http.StatusMethodNotAllowed, "")
+		return "", nil, fmt.Errorf("unsupported HTTP proxy method %s (only CONNECT)", req.Method)
+	}
+	if !auth.open() {
+		creds := &http.Request{Header: http.Header{"Authorization": req.Header.Values("Proxy-Authorization")}}
+		user, pass, ok := creds.BasicAuth()
+		if !ok || !auth.check(user, pass) {
+			status(http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"phantom\"\r\n")
+			return "", nil, fmt.Errorf("bad HTTP proxy credentials for user %q", user)
+		}
+	}
+	if _, port, err := net.SplitHostPort(req.Host); err != nil || !validPort(port) {
+		status(http.StatusBadRequest, "")
+		return "", nil, fmt.Errorf("invalid CONNECT target %q", req.Host)
+	}
+	return req.Host, func(r proxyResult) error {
+		if r == proxyOK {
+			_, err := io.WriteString(w, "HTTP/1.1 200 Connection established\r\n\r\n")
+			return err
+		}
+		return status(map[proxyResult]int{proxyNotAllowed: http.StatusForbidden, proxyUnreachable: http.StatusBadGateway, proxyUnavailable: http.StatusServiceUnavailable}[r], "")
+	}, nil
+}
+
+var processStart = time.Now()
+
+type tunnelStatus struct {
+	Name              string `json:"name"`
+	Mode              string `json:"mode"`
+	Transport         string `json:"transport"`
+	Running           bool   `json:"running"`
+	Paused            bool   `json:"paused"`
+	Error             string `json:"error,omitempty"`
+	ActiveConnections int    `json:"active_connections"`
+	TotalBytesIn      int64  `json:"total_bytes_in"`
+	TotalBytesOut     int64  `json:"total_bytes_out"`
+	Uptime            string `json:"uptime"`
+	Connected         bool   `json:"connected"`
+	Server            string `json:"server,omitempty"`
+	Clients           int    `json:"clients"`
+
+	Endpoints []EndpointStats `json:"endpoints"`
+	Quotas    []quotaStatus   `json:"quotas,omitempty"`
+	// Bans is how many IPs are banned from the tunnel listener.
+	Bans int `json:"bans,omitempty"`
+}
+
+func (t *Tunnel) Status() tunnelStatus {
+	t.mu.Lock()
+	st := tunnelStatus{Name: t.Name, Mode: t.cfg.Mode, Transport: t.cfg.Transport, Running: t.done != nil, Paused: t.paused}
+	if t.lastErr != nil {
+		st.Error = t.lastErr.Error()
+	}
+	t.mu.Unlock()
+	st.Quotas = t.quotaStatus()
+	st.Bans = len(t.Bans())
+	t.stats.Lock()
+	defer t.stats.Unlock()
+	st.ActiveConnections = t.stats.ActiveConnections
+	st.TotalBytesIn = t.stats.TotalBytesIn
+	st.TotalBytesOut = t.stats.TotalBytesOut
+	st.Connected = t.stats.Connected
+	st.Server = t.stats.Server
+	st.Clients = t.stats.Clients
+	st.Endpoints = t.stats.endpointSnapshot()
+	if st.Running {
+		st.Uptime = time.Since(t.stats.Uptime).Round(time.Second).String()
+	}
+	return st
+}
+
+const (
+	sessionCookieName = "phantom_session"
+	sessionLifetime   = 12 * time.Hour
+	// An IP that fails to log in maxLoginFailures times within
+	// loginFailureWindow is turned away until the window has passed.
+	maxLoginFailures   = 5
+	loginFailureWindow = 15 * time.Minute
+)
+
+// dashboardAuth checks panel logins and keeps the sessions handed out by
+// /login. Every request but the login page needs a user.
+type dashboardAuth struct {
+	mu       sync.Mutex
+	creds    *proxyAuth
+	sessions map[string]dashboardSession
+	failures map[string]loginFailures
+	secure   bool
+}
+
+// loginFailures counts the failed logins from one IP since first.
+type loginFailures struct {
+	count int
+	first time.Time
+}
+
+type dashboardSession struct {
+	user    string
+	expires time.Time
+}
+
+// dummyHash is checked for unknown usernames so a failed login takes as
+// long whether or not the user exists.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("phantom"), bcrypt.DefaultCost)
+	return hash
+})
+
+func newDashboardAuth(dc DashboardConfig) *dashboardAuth {
+	return &dashboardAuth{
+		creds:    newProxyAuth(dc.Users),
+		sessions: map[string]dashboardSession{},
+		failures: map[string]loginFailures{},
+		secure:   dc.TLS,
+	}
+}
+
+// checkPassword checks a login from the IP in remoteAddr. Passwords are not
+// tried at all while that IP is locked out. Each attempt is counted as a
+// failure before the password is checked, so parallel logins cannot all
+// slip under the limit, and handed back if it succeeds.
+func (a *dashboardAuth) checkPassword(remoteAddr, user, pass string) (ok, locked bool) {
+	ip := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		ip = host
+	}
+	now := time.Now()
+	a.mu.Lock()
+	for k, other := range a.failures {
+		if now.Sub(other.first) > loginFailureWindow {
+			delete(a.failures, k)
+		}
+	}
+	f := a.failures[ip]
+	if f.count >= maxLoginFailures {
+		a.mu.Unlock()
+		return false, true
+	}
+	if f.count == 0 {
+		f.first = now
+	}
+	f.count++
+	a.failures[ip] = f
+	a.mu.Unlock()
+
+	if !a.creds.check(user, pass) {
+		return false, f.count >= maxLoginFailures
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if f, found := a.failures[ip]; found {
+		if f.count--; f.count == 0 {
+			delete(a.failures, ip)
+		} else {
+			a.failures[ip] = f
+		}
+	}
+	return true, false
+}
+
+func (a *dashboardAuth) newSession(user string) string {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	id := hex.EncodeToString(buf)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for k, s := range a.sessions {
+		if now.After(s.expires) {
+			delete(a.sessions, k)
+		}
+	}
+	a.sessions[id] = dashboardSession{user: user, expires: now.Add(sessionLifetime)}
+	return id
+}
+
+func (a *dashboardAuth) endSession(id string) {
+	a.mu.Lock()
+	delete(a.sessions, id)
+	a.mu.Unlock()
+}
+
+// user returns who made the request, from the session cookie or, for
+// scrapers and scripts, HTTP basic auth.
+func (a *dashboardAuth) user(r *http.Request) (string, bool) {
+	if c, err := r.Cookie(sessionCookieName); err == nil {
+		a.mu.Lock()
+		s, ok := a.sessions[c.Value]
+		a.mu.Unlock()
+		if ok && time.Now().Before(s.expires) {
+			return s.user, true
+		}
+	}
+	if user, pass, ok := r.BasicAuth(); ok {
+		if ok, _ := a.checkPassword(r.RemoteAddr, user, pass); ok {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+func (a *dashboardAuth) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !sameOrigin(r) {
+			http.Error(w, "cross-origin request refused", http.StatusForbidden)
+			return
+		}
+		if r.URL.Path == "/login" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, ok := a.user(r); !ok {
+			if r.URL.Path == "/" {
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+				return
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sameOrigin reports false for a state-changing request another site made
+// the browser send, going by Sec-Fetch-Site or, in older browsers, Origin.
+// Requests without either come from scripts, not browsers.
+func sameOrigin(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "":
+	case "same-origin", "none":
+		return true
+	default:
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func (a *dashboardAuth) handleLogin(w http.ResponseWriter, r *http.Request) {
+	failed, locked := false, false
+	if r.Method == http.MethodPost {
+		user, pass := r.PostFormValue("username"), r.PostFormValue("password")
+		var ok bool
+		if ok, locked = a.checkPassword(r.RemoteAddr, user, pass); ok {
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookieName,
+				Value:    a.newSession(user),
+				Path:     "/",
+				MaxAge:   int(sessionLifetime / time.Second),
+				HttpOnly: true,
+				Secure:   a.secure,
+				SameSite: http.SameSiteStrictMode,
+			})
+			log.Printf("[Dashboard] %q logged in from %s", user, r.RemoteAddr)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		log.Printf("[Dashboard] Failed login for %q from %s", user, r.RemoteAddr)
+		failed = true
+	}
+	page := loginHTML
+	switch {
+	case locked:
+		page = strings.Replace(page, "<!--ERROR-->", `<div class="error">Too many failed logins. Try again later.</div>`, 1)
+	case failed:
+		page = strings.Replace(page, "<!--ERROR-->", `<div class="error">Wrong username or password.</div>`, 1)
+	}
+	w.Header().Set("Content-Type", "text/html")
+	switch {
+	case locked:
+		w.WriteHeader(http.StatusTooManyRequests)
+	case failed:
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	w.Write([]byte(page))
+}
+
+func (a *dashboardAuth) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if c, err := r.Cookie(sessionCookieName); err == nil {
+		a.endSession(c.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+const loginHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="UTF-8">
+  <title>Phantom Tunnel Login</title>
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <style>
+    body {
+      background: #f4f6fb;
+      color: #222;
+      font-family: 'Vazirmatn', 'Segoe UI', Arial, sans-serif;
+      margin: 0; padding: 0;
+    }
+    .container {
+      max-width: 340px;
+      margin: 80px auto;
+      padding: 24px 20px;
+      background: #fff;
+      border-radius: 22px;
+      box-shadow: 0 4px 24px #0001;
+    }
+    .title { text-align: center; font-size: 1.4rem; font-weight: 700; margin-bottom: 18px; }
+    input, button {
+      display: block;
+      width: 100%;
+      box-sizing: border-box;
+      margin-bottom: 12px;
+      padding: 10px 12px;
+      border-radius: 10px;
+      font-size: 1rem;
+    }
+    input { border: 1px solid #d5dce8; }
+    button { border: none; background: #387df6; color: #fff; font-weight: 600; cursor: pointer; }
+    .error { color: #e14c4c; text-align: center; margin-bottom: 12px; font-size: 0.9rem; }
+  </style>
+</head>
+<body>
+  <form class="container" method="post" action="/login">
+    <div class="title">👻 Phantom Tunnel</div>
+    <!--ERROR-->
+    <input name="username" placeholder="Username" autocomplete="username" autofocus>
+    <input name="password" type="password" placeholder="Password" autocomplete="current-password">
+    <button type="submit">Log in</button>
+  </form>
+</body>
+</html>
+`
+
+func startWebDashboard(dc DashboardConfig, tm *tunnelManager) {
+	if err := dc.validate(); err != nil {
+		log.Printf("[Dashboard] Not started: %v", err)
+		return
+	}
+	auth := newDashboardAuth(dc)
 	mux := http.NewServeMux()
+	mux.HandleFunc("/login", auth.handleLogin)
+	mux.HandleFunc("/logout", auth.handleLogout)
+	registerControlAPI(mux, tm)
 	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
-		stats.Lock()
-		defer stats.Unlock()
+		// The top-level fields add up every tunnel so the overview chart
+		// keeps working; the per-tunnel breakdown is in "tunnels".
 		info := struct {
-			ActiveConnections int    `json:"active_connections"`
-			TotalBytesIn      int64  `json:"total_bytes_in"`
-			TotalBytesOut     int64  `json:"total_bytes_out"`
-			Uptime            string `json:"uptime"`
-			Connected         bool   `json:"connected"`
+			ActiveConnections int            `json:"active_connections"`
+			TotalBytesIn      int64          `json:"total_bytes_in"`
+			TotalBytesOut     int64          `json:"total_bytes_out"`
+			Uptime            string         `json:"uptime"`
+			Connected         bool           `json:"connected"`
+			Clients           int            `json:"clients"`
+			Tunnels           []tunnelStatus `json:"tunnels"`
 		}{
-			ActiveConnections: stats.ActiveConnections,
-			TotalBytesIn:      stats.TotalBytesIn,
-			TotalBytesOut:     stats.TotalBytesOut,
-			Uptime:            time.Since(stats.Uptime).String(),
-			Connected:         stats.Connected,
+			Uptime:  time.Since(processStart).String(),
+			Tunnels: []tunnelStatus{},
+		}
+		for _, t := range tm.List() {
+			st := t.Status()
+			info.ActiveConnections += st.ActiveConnections
+			info.TotalBytesIn += st.TotalBytesIn
+			info.TotalBytesOut += st.TotalBytesOut
+			info.Connected = info.Connected || st.Connected
+			info.Clients += st.Clients
+			info.Tunnels = append(info.Tunnels, st)
 		}
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(info)
 	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, tm)
+	})
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		page := strings.Replace(dashboardHTML, "<!--LOGOUT-->", `<form class="logout" method="post" action="/logout"><button type="submit">Log out</button></form>`, 1)
 		w.Header().Set("Content-Type", "text/html")
-		w.Write([]byte(`
+		w.Write([]byte(page))
+	})
+
+	server := &http.Server{Addr: dc.addr(), Handler: auth.wrap(mux)}
+	var err error
+	if dc.TLS {
+		log.Printf("[Dashboard] Running at https://%s/", dc.addr())
+		err = server.ListenAndServeTLS(dc.CertFile, dc.KeyFile)
+	} else {
+		log.Printf("[Dashboard] Running at http://%s/", dc.addr())
+		err = server.ListenAndServe()
+	}
+	if err != nil {
+		log.Printf("[Dashboard] Stopped: %v", err)
+	}
+}
+
+const dashboardHTML = `
 <!DOCTYPE html>
 <html lang="en">
 <head>
@@ -786,6 +6847,14 @@ func startWebDashboard(port string) {
       flex-direction: column;
       gap: 24px;
     }
+    .logout { float: right; }
+    .logout button {
+      border: none;
+      background: none;
+      color: #7d93b2;
+      cursor: pointer;
+      font-size: 0.85rem;
+    }
     .title {
       text-align: center;
       font-size: 1.5rem;
@@ -871,6 +6940,58 @@ func startWebDashboard(port string) {
       flex-direction: column;
       align-items: center;
     }
+    .tunnel-list {
+      display: flex;
+      flex-direction: column;
+      gap: 8px;
+    }
+    .tunnel {
+      display: flex;
+      flex-wrap: wrap;
+      align-items: center;
+      justify-content: space-between;
+      background: #f4f8ff;
+      border-radius: 12px;
+      padding: 10px 14px;
+      font-size: 0.97rem;
+      box-shadow: 0 1px 8px #b1c6f41a;
+    }
+    .tunnel .name { font-weight: 700; }
+    .tunnel .meta { color: #7d93b2; font-size: 0.85rem; }
+    .tunnel .nums { text-align: right; color: #49597a; font-size: 0.88rem; }
+    .endpoints {
+      flex-basis: 100%;
+      margin-top: 8px;
+      border-collapse: collapse;
+      font-size: 0.82rem;
+      color: #49597a;
+    }
+    .endpoints td, .endpoints th { padding: 2px 6px; text-align: right; }
+    .endpoints td:first-child, .endpoints th:first-child { text-align: left; }
+    .endpoints th { color: #7d93b2; font-weight: 600; }
+    .quota { flex-basis: 100%; margin-top: 6px; font-size: 0.82rem; color: #49597a; }
+    .quota .bar { height: 6px; margin-top: 2px; background: #e3e8ef; border-radius: 3px; overflow: hidden; }
+    .quota .bar div { height: 100%; background: #387df6; }
+    .quota.over .bar div { background: #f24c4c; }
+    .actions { flex-basis: 100%; margin-top: 8px; display: flex; gap: 6px; flex-wrap: wrap; }
+    .actions button, .endpoints button, .new-tunnel button {
+      border: 1px solid #d5dce8;
+      background: #fff;
+      color: #49597a;
+      border-radius: 8px;
+      padding: 3px 10px;
+      font-size: 0.8rem;
+      cursor: pointer;
+    }
+    .new-tunnel { margin-top: 14px; color: #49597a; }
+    .new-tunnel summary { cursor: pointer; font-weight: 600; }
+    .new-tunnel form { display: grid; grid-template-columns: 1fr 1fr; gap: 6px; margin-top: 8px; }
+    .new-tunnel input, .new-tunnel select {
+      padding: 6px 8px;
+      border: 1px solid #d5dce8;
+      border-radius: 8px;
+      font-size: 0.85rem;
+    }
     .footer {
       text-align: center;
       color: #9daabb;
@@ -884,149 +7005,1227 @@ func startWebDashboard(port string) {
       .card { padding: 10px 0 7px 0; }
       .chart-container { min-height: 120px; }
     }
-  </style>
-</head>
-<body>
-  <div class="container">
-    <div class="title">👻 Phantom Tunnel Dashboard</div>
-    <div class="status-row">
-      <span id="status-dot" class="dot" style="background:#f6c7c7"></span>
-      <span id="status-label" class="status-label">Connecting...</span>
-    </div>
-    <div class="row">
-      <div class="card">
-        Active
-        <span class="value" id="active">0</span>
-      </div>
-      <div class="card">
-        Total In
-        <span class="value" id="in">0 B</span>
-      </div>
-      <div class="card">
-        Total Out
-        <span class="value" id="out">0 B</span>
-      </div>
-    </div>
-    <div class="uptime-card">
-      <span>Uptime: <b id="uptime">0s</b></span>
-    </div>
-    <div class="chart-container">
-      <canvas id="trafficChart" height="90"></canvas>
-    </div>
-    <div class="footer">
-      © 2025 Phantom Tunnel — webwizards-team
-    </div>
-  </div>
-  <script src="https://cdn.jsdelivr.net/npm/chart.js@4.4.1/dist/chart.umd.min.js"></script>
-  <script>
-    let lastIn = 0, lastOut = 0;
-    let trafficData = [];
-    let labels = [];
-    const MAX_POINTS = 60;
+  </style>
+</head>
+<body>
+  <div class="container">
+    <!--LOGOUT-->
+    <div class="title">👻 Phantom Tunnel Dashboard</div>
+    <div class="status-row">
+      <span id="status-dot" class="dot" style="background:#f6c7c7"></span>
+      <span id="status-label" class="status-label">Connecting...</span>
+    </div>
+    <div class="row">
+      <div class="card">
+        Active
+        <span class="value" id="active">0</span>
+      </div>
+      <div class="card">
+        Total In
+        <span class="value" id="in">0 B</span>
+      </div>
+      <div class="card">
+        Total Out
+        <span class="value" id="out">0 B</span>
+      </div>
+    </div>
+    <div class="uptime-card">
+      <span>Uptime: <b id="uptime">0s</b></span>
+    </div>
+    <div class="chart-container">
+      <canvas id="trafficChart" height="90"></canvas>
+    </div>
+    <div class="chart-container">
+      <canvas id="endpointChart" height="90"></canvas>
+    </div>
+    <div class="tunnel-list" id="tunnels"></div>
+    <details class="new-tunnel">
+      <summary>New tunnel</summary>
+      <form id="new-tunnel">
+        <input name="name" placeholder="Name" required>
+        <select name="mode"><option value="server">Server</option><option value="client">Client</option></select>
+        <select name="transport">
+          <option value="tcpmux">TCP Mux</option><option value="tcpmux+tls">TCP Mux + TLS</option>
+          <option value="wss">WSS</option><option value="quic">QUIC</option>
+        </select>
+        <input name="token" placeholder="Token" required>
+        <input name="listen" placeholder="Server: listen, e.g. :443">
+        <input name="public_ports" placeholder="Server: ports, e.g. 8000,8443">
+        <input name="server" placeholder="Client: server address">
+        <input name="local_targets" placeholder="Client: targets, e.g. localhost:3000">
+        <button type="submit">Create</button>
+      </form>
+    </details>
+    <div class="footer">
+      © 2025 Phantom Tunnel — webwizards-team
+    </div>
+  </div>
+  <script src="https://cdn.jsdelivr.net/npm/chart.js@4.4.1/dist/chart.umd.min.js"></script>
+  <script>
+    let lastIn = 0, lastOut = 0;
+    let trafficData = [];
+    let labels = [];
+    const MAX_POINTS = 60;
+
+    const ctx = document.getElementById('trafficChart').getContext('2d');
+    const chart = new Chart(ctx, {
+      type: 'line',
+      data: {
+        labels: labels,
+        datasets: [
+          {
+            label: "In (KB/s)",
+            data: [],
+            borderColor: "#387df6",
+            backgroundColor: "rgba(56,125,246,0.09)",
+            borderWidth: 2,
+            cubicInterpolationMode: 'monotone',
+            tension: 0.4,
+            pointRadius: 0,
+            fill: true,
+          },
+          {
+            label: "Out (KB/s)",
+            data: [],
+            borderColor: "#2bc48a",
+            backgroundColor: "rgba(43,196,138,0.09)",
+            borderWidth: 2,
+            cubicInterpolationMode: 'monotone',
+            tension: 0.4,
+            pointRadius: 0,
+            fill: true,
+          }
+        ]
+      },
+      options: {
+        responsive: true,
+        scales: {
+          x: { display: false },
+          y: {
+            beginAtZero: true,
+            ticks: { color: "#7d93b2" },
+            grid: { color: "#e3e8ef" }
+          }
+        },
+        plugins: {
+          legend: { labels: { color: "#49597a", font: { size: 13 } } }
+        }
+      }
+    });
+
+    const PALETTE = ["#387df6", "#2bc48a", "#f6a238", "#b455f2", "#f24c7c", "#2bb8c4", "#8a9a3b", "#6b6bd6"];
+    let endpointLast = {};
+    let endpointData = {};
+    const endpointChart = new Chart(document.getElementById('endpointChart').getContext('2d'), {
+      type: 'line',
+      data: { labels: labels, datasets: [] },
+      options: {
+        responsive: true,
+        animation: false,
+        scales: {
+          x: { display: false },
+          y: {
+            beginAtZero: true,
+            stacked: true,
+            title: { display: true, text: "KB/s per port / target", color: "#7d93b2" },
+            ticks: { color: "#7d93b2" },
+            grid: { color: "#e3e8ef" }
+          }
+        },
+        plugins: {
+          legend: { labels: { color: "#49597a", font: { size: 12 } } }
+        }
+      }
+    });
+
+    function updateEndpointChart(tunnels) {
+      let seen = {};
+      tunnels.forEach(t => (t.endpoints || []).forEach(ep => {
+        let key = t.name + ' · ' + ep.endpoint;
+        let total = ep.bytes_in + ep.bytes_out;
+        let rate = key in endpointLast ? Math.max(0, (total - endpointLast[key]) / 1024) : 0;
+        endpointLast[key] = total;
+        if (!(key in endpointData)) endpointData[key] = new Array(labels.length - 1).fill(0);
+        endpointData[key].push(rate);
+        seen[key] = true;
+      }));
+      Object.keys(endpointData).forEach(key => {
+        if (!seen[key]) { delete endpointData[key]; delete endpointLast[key]; return; }
+        while (endpointData[key].length > labels.length) endpointData[key].shift();
+      });
+      endpointChart.data.labels = labels;
+      endpointChart.data.datasets = Object.keys(endpointData).map((key, i) => ({
+        label: key,
+        data: endpointData[key],
+        borderColor: PALETTE[i % PALETTE.length],
+        backgroundColor: PALETTE[i % PALETTE.length] + "22",
+        borderWidth: 2,
+        tension: 0.4,
+        pointRadius: 0,
+        fill: true,
+      }));
+      endpointChart.update();
+    }
+
+    function formatBytes(bytes) {
+      if (bytes < 1024) return bytes + " B";
+      let k = 1024, sizes = ["KB", "MB", "GB", "TB"], i = -1;
+      do { bytes = bytes / k; i++; } while (bytes >= k && i < sizes.length - 1);
+      return bytes.toFixed(2) + " " + sizes[i];
+    }
+
+    function api(method, path, body) {
+      return fetch(path, {
+        method: method,
+        headers: { 'Content-Type': 'application/json' },
+        body: body ? JSON.stringify(body) : undefined
+      }).then(res => res.status == 204 ? {} : res.json()).then(data => {
+        if (data.error) alert(data.error);
+        updateStats();
+        return data;
+      });
+    }
+
+    function tunnelActions(t) {
+      let box = document.createElement('div');
+      box.className = 'actions';
+      let path = '/api/tunnels/' + encodeURIComponent(t.name);
+      let add = (label, fn) => {
+        let b = document.createElement('button');
+        b.innerText = label;
+        b.onclick = fn;
+        box.appendChild(b);
+      };
+      if (t.running) add('Pause', () => api('POST', path + '/pause'));
+      else add('Resume', () => api('POST', path + '/resume'));
+      if (t.mode == 'server') add('+ Port', () => {
+        let port = prompt('Public port to open');
+        if (port) api('POST', path + '/ports', { port: port.trim() });
+      });
+      add('Rate limit', () => {
+        let kb = prompt('KB/s per connection (0 is unlimited)', t.config ? t.config.rate_limit_kb : 0);
+        if (kb !== null) api('PUT', path + '/rate-limit', { rate_limit_kb: parseInt(kb, 10) || 0 });
+      });
+      if (t.bans > 0) add('Bans (' + t.bans + ')', () => {
+        fetch(path + '/bans').then(res => res.json()).then(bans => {
+          let list = bans.map(b => b.ip + ' until ' + new Date(b.until).toLocaleString() + ': ' + b.reason).join('\n');
+          if (confirm(list + '\n\nLift all ' + bans.length + ' bans?')) api('DELETE', path + '/bans');
+        });
+      });
+      if ((t.quotas || []).length > 0) add('Reset quotas', () => {
+        if (confirm('Start a new quota period for ' + t.name + '?')) api('POST', path + '/quotas/reset');
+      });
+      add('Delete', () => { if (confirm('Delete tunnel ' + t.name + '?')) api('DELETE', path); });
+      return box;
+    }
+
+    document.getElementById('new-tunnel').onsubmit = e => {
+      e.preventDefault();
+      let f = e.target, cfg = {};
+      ['name', 'mode', 'transport', 'token', 'listen', 'server'].forEach(k => {
+        if (f[k].value.trim()) cfg[k] = f[k].value.trim();
+      });
+      let list = k => f[k].value.split(',').map(s => s.trim()).filter(s => s);
+      if (cfg.mode == 'server') cfg.public_ports = list('public_ports');
+      else cfg.local_targets = list('local_targets');
+      if (cfg.mode == 'server') delete cfg.server; else delete cfg.listen;
+      api('POST', '/api/tunnels', cfg).then(data => { if (!data.error) f.reset(); });
+    };
+
+    function updateStats() {
+      fetch('/stats').then(res => {
+        if (res.status == 401) location.href = '/login';
+        return res.json();
+      }).then(stat => {
+        document.getElementById('active').innerText = stat.active_connections;
+        document.getElementById('in').innerText = formatBytes(stat.total_bytes_in);
+        document.getElementById('out').innerText = formatBytes(stat.total_bytes_out);
+        document.getElementById('uptime').innerText = stat.uptime;
+
+        let dot = document.getElementById('status-dot');
+        let label = document.getElementById('status-label');
+        if (stat.connected) {
+          dot.style.background = "#40dd7a";
+          label.innerText = "Connected";
+          label.style.color = "#269d5b";
+        } else {
+          dot.style.background = "#f24c4c";
+          label.innerText = "Disconnected";
+          label.style.color = "#b52121";
+        }
+
+        let list = document.getElementById('tunnels');
+        list.innerHTML = '';
+        (stat.tunnels || []).forEach(t => {
+          let row = document.createElement('div');
+          row.className = 'tunnel';
+          let color = !t.running ? "#aaaaaa" : (t.connected ? "#40dd7a" : "#f24c4c");
+          let state = !t.running ? (t.paused ? "Paused" : t.error ? "Error: " + t.error : "Stopped") : (t.connected ? "Connected" : "Waiting");
+          row.innerHTML =
+            '<div><span class="dot" style="background:' + color + '"></span>' +
+            '<span class="name"></span> <span class="meta"></span><div class="meta state"></div></div>' +
+            '<div class="nums">' + t.active_connections + ' active<br>' +
+            formatBytes(t.total_bytes_in) + ' in / ' + formatBytes(t.total_bytes_out) + ' out</div>';
+          row.querySelector('.name').innerText = t.name;
+          row.querySelector('.meta').innerText = t.mode + ' · ' + t.transport;
+          row.querySelector('.state').innerText = state;
+          if ((t.endpoints || []).length > 0) {
+            let table = document.createElement('table');
+            table.className = 'endpoints';
+            table.innerHTML = '<tr><th>' + (t.mode == 'server' ? 'Port' : 'Target') +
+              '</th><th>Active</th><th>Peak</th><th>Conns</th><th>Errors</th><th>Rejected</th><th>In</th><th>Out</th></tr>';
+            t.endpoints.forEach(ep => {
+              let tr = table.insertRow();
+              [ep.endpoint, ep.active_connections, ep.peak_connections, ep.total_connections, ep.errors, ep.rejected,
+               formatBytes(ep.bytes_in), formatBytes(ep.bytes_out)].forEach(v => { tr.insertCell().innerText = v; });
+              if (t.mode == 'server' && t.endpoints.length > 1) {
+                let b = document.createElement('button');
+                b.innerText = '✕';
+                b.title = 'Close this port';
+                let port = ep.endpoint.slice(ep.endpoint.lastIndexOf(':') + 1);
+                b.onclick = () => api('DELETE', '/api/tunnels/' + encodeURIComponent(t.name) + '/ports/' + port);
+                tr.insertCell().appendChild(b);
+              }
+            });
+            row.appendChild(table);
+          }
+          (t.quotas || []).forEach(q => {
+            let div = document.createElement('div');
+            div.className = 'quota' + (q.exceeded ? ' over' : '');
+            div.innerHTML = '<span></span><div class="bar"><div></div></div>';
+            div.querySelector('span').innerText = 'Quota ' + (q.port || 'tunnel') + ': ' +
+              formatBytes(q.used_bytes) + ' of ' + formatBytes(q.limit_bytes) + ' (' + q.percent + '%)' +
+              (q.exceeded ? (q.action == 'throttle' ? ', throttled' : ', refusing connections') : '') +
+              (q.resets_at ? ' · resets ' + new Date(q.resets_at * 1000).toLocaleString() : '');
+            div.querySelector('.bar div').style.width = Math.min(100, q.percent) + '%';
+            row.appendChild(div);
+          });
+          row.appendChild(tunnelActions(t));
+          list.appendChild(row);
+        });
+
+        let nowIn = stat.total_bytes_in;
+        let nowOut = stat.total_bytes_out;
+        let inDiff = Math.max(0, (nowIn - lastIn) / 1024);
+        let outDiff = Math.max(0, (nowOut - lastOut) / 1024);
+        lastIn = nowIn; lastOut = nowOut;
+        if (trafficData.length >= MAX_POINTS) {
+          trafficData.shift();
+          labels.shift();
+        }
+        trafficData.push({in: inDiff, out: outDiff});
+        labels.push('');
+        chart.data.labels = labels;
+        chart.data.datasets[0].data = trafficData.map(val => val.in);
+        chart.data.datasets[1].data = trafficData.map(val => val.out);
+        chart.update();
+        updateEndpointChart(stat.tunnels || []);
+      }).catch(()=>{
+        let dot = document.getElementById('status-dot');
+        let label = document.getElementById('status-label');
+        dot.style.background = "#aaaaaa";
+        label.innerText = "Connecting...";
+        label.style.color = "#888";
+      });
+    }
+    setInterval(updateStats, 1000); updateStats();
+  </script>
+</body>
+</html>
+`
+
+// =========================================================================
+//                             CONTROL API
+// =========================================================================
+
+// tunnelView is how the control API shows a tunnel: its status plus its
+// config, with the token left out.
+type tunnelView struct {
+	tunnelStatus
+	Config *Config `json:"config"`
+}
+
+func viewTunnel(t *Tunnel) tunnelView {
+	cfg := t.Config()
+	redactSecrets(cfg)
+	return tunnelView{tunnelStatus: t.Status(), Config: cfg}
+}
+
+// redactSecrets blanks the token and the proxy password hashes, which the
+// API never shows.
+func redactSecrets(cfg *Config) {
+	cfg.Token = ""
+	for i := range cfg.Proxy.Users {
+		cfg.Proxy.Users[i].PasswordHash = ""
+	}
+}
+
+// keepSecrets fills in the secrets a PATCH left empty from old, so a config
+// read from the API can be sent back as it is. Proxy users are matched by
+// name.
+func keepSecrets(cfg, old *Config) {
+	if cfg.Token == "" {
+		cfg.Token = old.Token
+	}
+	for i, u := range cfg.Proxy.Users {
+		if u.PasswordHash != "" {
+			continue
+		}
+		for _, o := range old.Proxy.Users {
+			if o.Username == u.Username {
+				cfg.Proxy.Users[i].PasswordHash = o.PasswordHash
+			}
+		}
+	}
+}
+
+// registerControlAPI adds the JSON endpoints for managing tunnels at
+// runtime. They sit behind the dashboard login like every other page,
+// refuse cross-origin requests and only take application/json bodies.
+//
+//	GET    /api/tunnels                    list tunnels
+//	POST   /api/tunnels                    create and start a tunnel
+//	GET    /api/tunnels/{name}             show one tunnel
+//	PATCH  /api/tunnels/{name}             change config fields
+//	DELETE /api/tunnels/{name}             stop and delete
+//	POST   /api/tunnels/{name}/pause       stop, keep the config
+//	POST   /api/tunnels/{name}/resume      start again
+//	POST   /api/tunnels/{name}/ports       open a public port {"port": "8443"}
+//	DELETE /api/tunnels/{name}/ports/{port}
+//	PUT    /api/tunnels/{name}/rate-limit  {"rate_limit_kb": 512}
+//	PUT    /api/tunnels/{name}/rate-limits {"tunnel": {"in_kb": 1024, "out_kb": 4096}, ...}
+//	GET    /api/rate-limit                 the process-wide limit
+//	PUT    /api/rate-limit                 {"in_kb": 0, "out_kb": 8192, "burst_kb": 512}
+//	GET    /api/tunnels/{name}/traffic     history, ?hours=24 (panel mode)
+//	POST   /api/tunnels/{name}/quotas/reset start a new period, ?port=8443 for one quota
+//	GET    /api/tunnels/{name}/bans        IPs banned for failing the tunnel handshake
+//	DELETE /api/tunnels/{name}/bans        lift every ban
+//	DELETE /api/tunnels/{name}/bans/{ip}
+func registerControlAPI(mux *http.ServeMux, tm *tunnelManager) {
+	mux.HandleFunc("GET /api/tunnels", func(w http.ResponseWriter, r *http.Request) {
+		views := []tunnelView{}
+		for _, t := range tm.List() {
+			views = append(views, viewTunnel(t))
+		}
+		writeJSON(w, http.StatusOK, views)
+	})
+	mux.HandleFunc("POST /api/tunnels", func(w http.ResponseWriter, r *http.Request) {
+		cfg := &Config{}
+		if !decodeJSON(w, r, cfg) {
+			return
+		}
+		if err := prepareAPIConfig(tm, cfg); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		t, err := tm.Add(cfg)
+		if err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		if err := t.Start(); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		log.Printf("[API] Created tunnel %q", t.Name)
+		tm.save(t)
+		writeJSON(w, http.StatusCreated, viewTunnel(t))
+	})
+	mux.HandleFunc("GET /api/tunnels/{name}", withTunnel(tm, func(w http.ResponseWriter, r *http.Request, t *Tunnel) {
+		writeJSON(w, http.StatusOK, viewTunnel(t))
+	}))
+	// PATCH merges the given fields into the current config. The token and
+	// proxy password hashes stay as they are unless new ones are given.
+	mux.HandleFunc("PATCH /api/tunnels/{name}", withTunnel(tm, func(w http.ResponseWriter, r *http.Request, t *Tunnel) {
+		cfg := t.Config()
+		redactSecrets(cfg)
+		if !decodeJSON(w, r, cfg) {
+			return
+		}
+		keepSecrets(cfg, t.Config())
+		if cfg.Name != t.Name {
+			writeError(w, http.StatusBadRequest, errors.New("tunnels cannot be renamed"))
+			return
+		}
+		if err := prepareAPIConfig(tm, cfg); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := t.Reconfigure(cfg); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		log.Printf("[API] Updated tunnel %q", t.Name)
+		tm.save(t)
+		writeJSON(w, http.StatusOK, viewTunnel(t))
+	}))
+	mux.HandleFunc("DELETE /api/tunnels/{name}", withTunnel(tm, func(w http.ResponseWriter, r *http.Request, t *Tunnel) {
+		if err := tm.Remove(t.Name); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		log.Printf("[API] Deleted tunnel %q", t.Name)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("POST /api/tunnels/{name}/pause", withTunnel(tm, func(w http.ResponseWriter, r *http.Request, t *Tunnel) {
+		t.Pause()
+		log.Printf("[API] Paused tunnel %q", t.Name)
+		tm.save(t)
+		writeJSON(w, http.StatusOK, viewTunnel(t))
+	}))
+	mux.HandleFunc("POST /api/tunnels/{name}/resume", withTunnel(tm, func(w http.ResponseWriter, r *http.Request, t *Tunnel) {
+		if err := t.Resume(); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		log.Printf("[API] Resumed tunnel %q", t.Name)
+		tm.save(t)
+		writeJSON(w, http.StatusOK, viewTunnel(t))
+	}))
+	mux.HandleFunc("POST /api/tunnels/{name}/ports", withTunnel(tm, func(w http.ResponseWriter, r *http.Request, t *Tunnel) {
+		var req struct {
+			Port string `json:"port"`
+		}
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		_, port := splitService(req.Port)
+		if _, port = splitNetwork(port); !validPort(port) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid port %q", req.Port))
+			return
+		}
+		cfg := t.Config()
+		cfg.PublicPorts = append(cfg.PublicPorts, req.Port)
+		if err := cfg.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := tm.checkPorts(cfg); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		if err := t.AddPort(req.Port); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		log.Printf("[API] Opened port %s on tunnel %q", req.Port, t.Name)
+		tm.save(t)
+		writeJSON(w, http.StatusOK, viewTunnel(t))
+	}))
+	mux.HandleFunc("DELETE /api/tunnels/{name}/ports/{port}", withTunnel(tm, func(w http.ResponseWriter, r *http.Request, t *Tunnel) {
+		if err := t.RemovePort(r.PathValue("port")); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		log.Printf("[API] Closed port %s on tunnel %q", r.PathValue("port"), t.Name)
+		tm.save(t)
+		writeJSON(w, http.StatusOK, viewTunnel(t))
+	}))
+	mux.HandleFunc("GET /api/tunnels/{name}/traffic", withTunnel(tm, func(w http.ResponseWriter, r *http.Request, t *Tunnel) {
+		if tm.store == nil {
+			writeError(w, http.StatusNotFound, errors.New("traffic history is only kept in panel mode"))
+			return
+		}
+		hours, err := strconv.Atoi(r.URL.Query().Get("hours"))
+		if err != nil || hours <= 0 {
+			hours = 24
+		}
+		samples, err := tm.store.TrafficHistory(t.Name, time.Now().Add(-time.Duration(hours)*time.Hour))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, samples)
+	}))
+	mux.HandleFunc("PUT /api/tunnels/{name}/rate-limit", withTunnel(tm, func(w http.ResponseWriter, r *http.Request, t *Tunnel) {
+		var req struct {
+			RateLimitKB int `json:"rate_limit_kb"`
+		}
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if req.RateLimitKB < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("rate_limit_kb must not be negative"))
+			return
+		}
+		t.SetRateLimit(req.RateLimitKB)
+		tm.save(t)
+		writeJSON(w, http.StatusOK, viewTunnel(t))
+	}))
+	mux.HandleFunc("PUT /api/tunnels/{name}/rate-limits", withTunnel(tm, func(w http.ResponseWriter, r *http.Request, t *Tunnel) {
+		var rl RateLimits
+		if !decodeJSON(w, r, &rl) {
+			return
+		}
+		if err := rl.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		t.SetRateLimits(rl)
+		tm.save(t)
+		writeJSON(w, http.StatusOK, viewTunnel(t))
+	}))
+	mux.HandleFunc("POST /api/tunnels/{name}/quotas/reset", withTunnel(tm, func(w http.ResponseWriter, r *http.Request, t *Tunnel) {
+		if err := t.ResetQuotas(r.URL.Query().Get("port")); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		log.Printf("[API] Reset quotas of tunnel %q", t.Name)
+		saveQuotas(tm)
+		writeJSON(w, http.StatusOK, viewTunnel(t))
+	}))
+	mux.HandleFunc("GET /api/tunnels/{name}/bans", withTunnel(tm, func(w http.ResponseWriter, r *http.Request, t *Tunnel) {
+		writeJSON(w, http.StatusOK, t.Bans())
+	}))
+	mux.HandleFunc("DELETE /api/tunnels/{name}/bans", withTunnel(tm, func(w http.ResponseWriter, r *http.Request, t *Tunnel) {
+		n, _ := t.ClearBans("")
+		log.Printf("[API] Lifted %d bans on tunnel %q", n, t.Name)
+		writeJSON(w, http.StatusOK, t.Bans())
+	}))
+	mux.HandleFunc("DELETE /api/tunnels/{name}/bans/{ip}", withTunnel(tm, func(w http.ResponseWriter, r *http.Request, t *Tunnel) {
+		n, err := t.ClearBans(r.PathValue("ip"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if n == 0 {
+			writeError(w, http.StatusNotFound, fmt.Errorf("%s is not banned", r.PathValue("ip")))
+			return
+		}
+		log.Printf("[API] Lifted the ban on %s for tunnel %q", r.PathValue("ip"), t.Name)
+		writeJSON(w, http.StatusOK, t.Bans())
+	}))
+	mux.HandleFunc("GET /api/rate-limit", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, globalLimits.get())
+	})
+	mux.HandleFunc("PUT /api/rate-limit", func(w http.ResponseWriter, r *http.Request) {
+		var l BandwidthLimit
+		if !decodeJSON(w, r, &l) {
+			return
+		}
+		if err := l.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if tm.store != nil {
+			if err := tm.store.SetGlobalRateLimit(l); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+		globalLimits.set(l)
+		log.Printf("[API] Global rate limit set to %v", l)
+		writeJSON(w, http.StatusOK, l)
+	})
+}
+
+func withTunnel(tm *tunnelManager, h func(http.ResponseWriter, *http.Request, *Tunnel)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := tm.Get(r.PathValue("name"))
+		if t == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("tunnel %q not found", r.PathValue("name")))
+			return
+		}
+		h(w, r, t)
+	}
+}
+
+// prepareAPIConfig fills in defaults and checks a tunnel config sent to
+// the API, the same way loadConfig does for a file.
+func prepareAPIConfig(tm *tunnelManager, cfg *Config) error {
+	if !validTunnelName(cfg.Name) {
+		return errors.New("name must be 1-64 letters, digits, '-' or '_'")
+	}
+	cfg.applyDefaults()
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	return tm.checkPorts(cfg)
+}
+
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	// A form cannot send this content type, so requiring it keeps other
+	// sites from posting to the API through a logged-in browser.
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, errors.New("Content-Type must be application/json"))
+		return false
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid JSON: %w", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// =========================================================================
+//                             PANEL
+// =========================================================================
+
+const (
+	panelDBFile = "config.db"
+	// stateDBFile keeps quota usage and bans for tunnels run from a config
+	// file. It is apart from the panel's database so that running one
+	// never looks like a panel that was set up, or touches its rows.
+	stateDBFile           = "state.db"
+	trafficSampleInterval = time.Minute
+	trafficRetention      = 30 * 24 * time.Hour
+)
+
+// migrations are applied in order; PRAGMA user_version records how many
+// have run. Only ever append to this list.
+var migrations = []string{
+	`CREATE TABLE settings (
+		key   TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
+	CREATE TABLE users (
+		username      TEXT PRIMARY KEY,
+		password_hash TEXT NOT NULL,
+		created_at    INTEGER NOT NULL
+	);
+	CREATE TABLE tunnels (
+		id     INTEGER PRIMARY KEY AUTOINCREMENT,
+		name   TEXT NOT NULL UNIQUE,
+		mode   TEXT NOT NULL,
+		config TEXT NOT NULL,
+		paused INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE traffic_samples (
+		tunnel      TEXT NOT NULL,
+		endpoint    TEXT NOT NULL,
+		ts          INTEGER NOT NULL,
+		bytes_in    INTEGER NOT NULL,
+		bytes_out   INTEGER NOT NULL,
+		connections INTEGER NOT NULL,
+		active      INTEGER NOT NULL
+	);
+	CREATE INDEX traffic_samples_tunnel_ts ON traffic_samples (tunnel, ts);`,
+	`CREATE TABLE quota_usage (
+		tunnel       TEXT NOT NULL,
+		endpoint     TEXT NOT NULL,
+		period_start INTEGER NOT NULL,
+		used         INTEGER NOT NULL,
+		PRIMARY KEY (tunnel, endpoint)
+	);`,
+	`CREATE TABLE bans (
+		tunnel  TEXT NOT NULL,
+		ip      TEXT NOT NULL,
+		reason  TEXT NOT NULL,
+		since   INTEGER NOT NULL,
+		until   INTEGER NOT NULL,
+		strikes INTEGER NOT NULL,
+		PRIMARY KEY (tunnel, ip)
+	);`,
+}
+
+type storedTunnel struct {
+	Config *Config
+	Paused bool
+}
+
+// trafficSample is one row of traffic_samples. The byte and connection
+// counts are running totals; endpoint is empty for the whole tunnel.
+type trafficSample struct {
+	Tunnel      string `json:"-"`
+	Endpoint    string `json:"endpoint,omitempty"`
+	Time        int64  `json:"ts"`
+	BytesIn     int64  `json:"bytes_in"`
+	BytesOut    int64  `json:"bytes_out"`
+	Connections int64  `json:"connections"`
+	Active      int    `json:"active"`
+}
+
+// panelStore keeps the panel settings, users, tunnels and traffic history
+// in a SQLite database.
+type panelStore struct {
+	db   *sql.DB
+	path string
+}
+
+func openPanelStore(dir string) (*panelStore, error) {
+	return openStore(dir, panelDBFile)
+}
+
+// openStateStore opens the store config-file tunnels keep their state in.
+func openStateStore(dir string) (*panelStore, error) {
+	return openStore(dir, stateDBFile)
+}
+
+func openStore(dir, file string) (*panelStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, file)
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// Some pragmas are per connection; one connection also keeps writes
+	// from ever contending.
+	db.SetMaxOpenConns(1)
+	ps := &panelStore{db: db, path: path}
+	if err := ps.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	os.Chmod(path, 0600)
+	return ps, nil
+}
+
+func (ps *panelStore) migrate() error {
+	var version int
+	if err := ps.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database is at schema version %d, this build only knows %d", version, len(migrations))
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := ps.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("[Panel] Database migrated to schema version %d", i+1)
+	}
+	return nil
+}
+
+func (ps *panelStore) Close() error {
+	return ps.db.Close()
+}
+
+func (ps *panelStore) Settings() (DashboardConfig, error) {
+	var dc DashboardConfig
+	rows, err := ps.db.Query("SELECT key, value FROM settings")
+	if err != nil {
+		return dc, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return dc, err
+		}
+		switch key {
+		case "listen":
+			dc.Listen = value
+		case "port":
+			dc.Port = value
+		case "tls":
+			dc.TLS = value == "true"
+		case "cert_file":
+			dc.CertFile = value
+		case "key_file":
+			dc.KeyFile = value
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return dc, err
+	}
+
+	users, err := ps.db.Query("SELECT username, password_hash FROM users ORDER BY created_at")
+	if err != nil {
+		return dc, err
+	}
+	defer users.Close()
+	for users.Next() {
+		var u DashboardUser
+		if err := users.Scan(&u.Username, &u.PasswordHash); err != nil {
+			return dc, err
+		}
+		dc.Users = append(dc.Users, u)
+	}
+	return dc, users.Err()
+}
+
+func (ps *panelStore) SetSetting(key, value string) error {
+	_, err := ps.db.Exec(`INSERT INTO settings (key, value) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value`, key, value)
+	return err
+}
+
+// GlobalRateLimit returns the process-wide bandwidth limit, zero if none
+// was set.
+func (ps *panelStore) GlobalRateLimit() (BandwidthLimit, error) {
+	var l BandwidthLimit
+	var value string
+	err := ps.db.QueryRow("SELECT value FROM settings WHERE key = 'global_rate_limit'").Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return l, nil
+	} else if err != nil {
+		return l, err
+	}
+	return l, json.Unmarshal([]byte(value), &l)
+}
+
+func (ps *panelStore) SetGlobalRateLimit(l BandwidthLimit) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return ps.SetSetting("global_rate_limit", string(data))
+}
+
+// SetUser adds a panel user or changes its password.
+func (ps *panelStore) SetUser(username, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = ps.db.Exec(`INSERT INTO users (username, password_hash, created_at) VALUES (?, ?, ?)
+		ON CONFLICT (username) DO UPDATE SET password_hash = excluded.password_hash`,
+		username, string(hash), time.Now().Unix())
+	return err
+}
+
+func (ps *panelStore) Tunnels() ([]storedTunnel, error) {
+	rows, err := ps.db.Query("SELECT config, paused FROM tunnels ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []storedTunnel
+	for rows.Next() {
+		var data string
+		st := storedTunnel{Config: &Config{}}
+		if err := rows.Scan(&data, &st.Paused); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), st.Config); err != nil {
+			return nil, err
+		}
+		out = append(out, st)
+	}
+	return out, rows.Err()
+}
+
+func (ps *panelStore) SaveTunnel(cfg *Config, paused bool) error {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = ps.db.Exec(`INSERT INTO tunnels (name, mode, config, paused) VALUES (?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET mode = excluded.mode, config = excluded.config, paused = excluded.paused`,
+		cfg.Name, cfg.Mode, string(data), paused)
+	return err
+}
+
+// DeleteTunnel removes a tunnel and its traffic history, so a new tunnel
+// with the same name starts from zero.
+func (ps *panelStore) DeleteTunnel(name string) error {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM tunnels WHERE name = ?", name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM traffic_samples WHERE tunnel = ?", name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM quota_usage WHERE tunnel = ?", name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM bans WHERE tunnel = ?", name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-    const ctx = document.getElementById('trafficChart').getContext('2d');
-    const chart = new Chart(ctx, {
-      type: 'line',
-      data: {
-        labels: labels,
-        datasets: [
-          {
-            label: "In (KB/s)",
-            data: [],
-            borderColor: "#387df6",
-            backgroundColor: "rgba(56,125,246,0.09)",
-            borderWidth: 2,
-            cubicInterpolationMode: 'monotone',
-            tension: 0.4,
-            pointRadius: 0,
-            fill: true,
-          },
-          {
-            label: "Out (KB/s)",
-            data: [],
-            borderColor: "#2bc48a",
-            backgroundColor: "rgba(43,196,138,0.09)",
-            borderWidth: 2,
-            cubicInterpolationMode: 'monotone',
-            tension: 0.4,
-            pointRadius: 0,
-            fill: true,
-          }
-        ]
-      },
-      options: {
-        responsive: true,
-        scales: {
-          x: { display: false },
-          y: {
-            beginAtZero: true,
-            ticks: { color: "#7d93b2" },
-            grid: { color: "#e3e8ef" }
-          }
-        },
-        plugins: {
-          legend: { labels: { color: "#49597a", font: { size: 13 } } }
-        }
-      }
-    });
+// QuotaUsage returns the saved usage of a tunnel's quotas by endpoint.
+func (ps *panelStore) QuotaUsage(tunnel string) (map[string]quotaUsage, error) {
+	rows, err := ps.db.Query("SELECT endpoint, period_start, used FROM quota_usage WHERE tunnel = ?", tunnel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	usage := map[string]quotaUsage{}
+	for rows.Next() {
+		var endpoint string
+		var start int64
+		var u quotaUsage
+		if err := rows.Scan(&endpoint, &start, &u.Used); err != nil {
+			return nil, err
+		}
+		if start != 0 {
+			u.Start = time.Unix(start, 0)
+		}
+		usage[endpoint] = u
+	}
+	return usage, rows.Err()
+}
 
-    function formatBytes(bytes) {
-      if (bytes < 1024) return bytes + " B";
-      let k = 1024, sizes = ["KB", "MB", "GB", "TB"], i = -1;
-      do { bytes = bytes / k; i++; } while (bytes >= k && i < sizes.length - 1);
-      return bytes.toFixed(2) + " " + sizes[i];
-    }
+// Bans returns the bans saved for a tunnel, expired ones included.
+func (ps *panelStore) Bans(tunnel string) ([]ban, error) {
+	rows, err := ps.db.Query("SELECT ip, reason, since, until, strikes FROM bans WHERE tunnel = ?", tunnel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []ban
+	for rows.Next() {
+		var b ban
+		var since, until int64
+		if err := rows.Scan(&b.IP, &b.Reason, &since, &until, &b.Strikes); err != nil {
+			return nil, err
+		}
+		b.Since, b.Until = time.Unix(since, 0), time.Unix(until, 0)
+		out = append(out, b)
+	}
+	return out, rows.Err()
+}
 
-    function updateStats() {
-      fetch('/stats').then(res => res.json()).then(stat => {
-        document.getElementById('active').innerText = stat.active_connections;
-        document.getElementById('in').innerText = formatBytes(stat.total_bytes_in);
-        document.getElementById('out').innerText = formatBytes(stat.total_bytes_out);
-        document.getElementById('uptime').innerText = stat.uptime;
+// SaveBans replaces the saved bans of a tunnel.
+func (ps *panelStore) SaveBans(tunnel string, bans []ban) error {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM bans WHERE tunnel = ?", tunnel); err != nil {
+		return err
+	}
+	for _, b := range bans {
+		if _, err := tx.Exec("INSERT INTO bans (tunnel, ip, reason, since, until, strikes) VALUES (?, ?, ?, ?, ?, ?)",
+			tunnel, b.IP, b.Reason, b.Since.Unix(), b.Until.Unix(), b.Strikes); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
 
-        let dot = document.getElementById('status-dot');
-        let label = document.getElementById('status-label');
-        if (stat.connected) {
-          dot.style.background = "#40dd7a";
-          label.innerText = "Connected";
-          label.style.color = "#269d5b";
-        } else {
-          dot.style.background = "#f24c4c";
-          label.innerText = "Disconnected";
-          label.style.color = "#b52121";
-        }
+// SaveQuotaUsage replaces the saved usage of a tunnel's quotas.
+func (ps *panelStore) SaveQuotaUsage(tunnel string, usage map[string]quotaUsage) error {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM quota_usage WHERE tunnel = ?", tunnel); err != nil {
+		return err
+	}
+	for endpoint, u := range usage {
+		var start int64
+		if !u.Start.IsZero() {
+			start = u.Start.Unix()
+		}
+		if _, err := tx.Exec("INSERT INTO quota_usage (tunnel, endpoint, period_start, used) VALUES (?, ?, ?, ?)",
+			tunnel, endpoint, start, u.Used); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
 
-        let nowIn = stat.total_bytes_in;
-        let nowOut = stat.total_bytes_out;
-        let inDiff = Math.max(0, (nowIn - lastIn) / 1024);
-        let outDiff = Math.max(0, (nowOut - lastOut) / 1024);
-        lastIn = nowIn; lastOut = nowOut;
-        if (trafficData.length >= MAX_POINTS) {
-          trafficData.shift();
-          labels.shift();
-        }
-        trafficData.push({in: inDiff, out: outDiff});
-        labels.push('');
-        chart.data.labels = labels;
-        chart.data.datasets[0].data = trafficData.map(val => val.in);
-        chart.data.datasets[1].data = trafficData.map(val => val.out);
-        chart.update();
-      }).catch(()=>{
-        let dot = document.getElementById('status-dot');
-        let label = document.getElementById('status-label');
-        dot.style.background = "#aaaaaa";
-        label.innerText = "Connecting...";
-        label.style.color = "#888";
-      });
-    }
-    setInterval(updateStats, 1000); updateStats();
-  </script>
-</body>
-</html>
-		`))
-	})
-	log.Printf("[Dashboard] Running at http://localhost%s/", port)
-	http.ListenAndServe(port, mux)
+func (ps *panelStore) RecordTraffic(samples []trafficSample) error {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, s := range samples {
+		if _, err := tx.Exec(`INSERT INTO traffic_samples (tunnel, endpoint, ts, bytes_in, bytes_out, connections, active)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`, s.Tunnel, s.Endpoint, s.Time, s.BytesIn, s.BytesOut, s.Connections, s.Active); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM traffic_samples WHERE ts < ?", time.Now().Add(-trafficRetention).Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// LastTraffic returns the newest sample of the tunnel and of each of its
+// endpoints, so counters carry on across restarts.
+func (ps *panelStore) LastTraffic(tunnel string) ([]trafficSample, error) {
+	rows, err := ps.db.Query(`SELECT endpoint, ts, bytes_in, bytes_out, connections, active FROM traffic_samples
+		WHERE tunnel = ? AND ts = (SELECT MAX(ts) FROM traffic_samples WHERE tunnel = ?)`, tunnel, tunnel)
+	if err != nil {
+		return nil, err
+	}
+	return scanSamples(tunnel, rows)
+}
+
+// TrafficHistory returns the tunnel-wide samples taken since the given time.
+func (ps *panelStore) TrafficHistory(tunnel string, since time.Time) ([]trafficSample, error) {
+	rows, err := ps.db.Query(`SELECT endpoint, ts, bytes_in, bytes_out, connections, active FROM traffic_samples
+		WHERE tunnel = ? AND endpoint = '' AND ts >= ? ORDER BY ts`, tunnel, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	return scanSamples(tunnel, rows)
+}
+
+func scanSamples(tunnel string, rows *sql.Rows) ([]trafficSample, error) {
+	defer rows.Close()
+	out := []trafficSample{}
+	for rows.Next() {
+		s := trafficSample{Tunnel: tunnel}
+		if err := rows.Scan(&s.Endpoint, &s.Time, &s.BytesIn, &s.BytesOut, &s.Connections, &s.Active); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// recordTraffic samples every tunnel's counters into the store until ctx
+// ends. The last sample is up to the caller, once the tunnels have stopped.
+func recordTraffic(ctx context.Context, tm *tunnelManager) {
+	ticker := time.NewTicker(trafficSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			saveTraffic(tm)
+		}
+	}
+}
+
+func saveTraffic(tm *tunnelManager) {
+	now := time.Now().Unix()
+	var samples []trafficSample
+	for _, t := range tm.List() {
+		samples = append(samples, t.stats.samples(t.Name, now)...)
+	}
+	if err := tm.store.RecordTraffic(samples); err != nil {
+		log.Printf("[Panel] Failed to record traffic: %v", err)
+	}
+}
+
+// setupPanel is the one-shot --setup-* command install.sh runs before the
+// service starts for the first time. Only the values given are changed.
+func setupPanel(dataDir, listen, port, user, pass string) error {
+	if port != "" && !validPort(port) {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	if (user == "") != (pass == "") {
+		return errors.New("--setup-user and --setup-pass must be given together")
+	}
+	store, err := openPanelStore(dataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	current, err := store.Settings()
+	if err != nil {
+		return err
+	}
+	if current.Port == "" && port == "" {
+		port = defaultDashboardPort("server")
+	}
+	if current.Listen == "" && listen == "" {
+		// The panel always has a login, so unlike the plain dashboard it
+		// listens on every interface by default.
+		listen = "0.0.0.0"
+	}
+	for key, value := range map[string]string{"listen": listen, "port": port} {
+		if value == "" {
+			continue
+		}
+		if err := store.SetSetting(key, value); err != nil {
+			return err
+		}
+	}
+	if user != "" {
+		if err := store.SetUser(user, pass); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("✅ Panel settings saved to %s\n", store.path)
+	return nil
+}
+
+// runPanel is the long-running --start-panel mode: it starts every stored
+// tunnel and serves the management UI until it is told to stop.
+func runPanel(dataDir string) {
+	store, err := openPanelStore(dataDir)
+	if err != nil {
+		log.Fatalf("[Panel] %v", err)
+	}
+	defer store.Close()
+	dc, err := store.Settings()
+	if err != nil {
+		log.Fatalf("[Panel] %v", err)
+	}
+	if dc.Port == "" || len(dc.Users) == 0 {
+		log.Fatalf("[Panel] Not set up yet. Run: phantom --setup-port=8080 --setup-user=admin --setup-pass=...")
+	}
+	dc.applyDefaults()
+	if l, err := store.GlobalRateLimit(); err != nil {
+		log.Printf("[Panel] Could not load the global rate limit: %v", err)
+	} else {
+		globalLimits.set(l)
+	}
+
+	tm := newTunnelManager()
+	tm.store, tm.state = store, store
+	stored, err := store.Tunnels()
+	if err != nil {
+		log.Fatalf("[Panel] %v", err)
+	}
+	for _, st := range stored {
+		cfg := st.Config
+		if err := prepareAPIConfig(tm, cfg); err != nil {
+			log.Printf("[Panel] Skipping tunnel %q: %v", cfg.Name, err)
+			continue
+		}
+		t, err := tm.Add(cfg)
+		if err != nil {
+			log.Printf("[Panel] Skipping tunnel %q: %v", cfg.Name, err)
+			continue
+		}
+		if last, err := store.LastTraffic(cfg.Name); err != nil {
+			log.Printf("[Panel] Could not load traffic of %q: %v", cfg.Name, err)
+		} else {
+			t.stats.restore(last)
+		}
+		if st.Paused {
+			t.Pause()
+			continue
+		}
+		if err := t.Start(); err != nil {
+			log.Printf("[Panel] %v", err)
+		}
+	}
+	log.Printf("[Panel] Loaded %d tunnels from %s", len(tm.List()), store.path)
+	go startWebDashboard(dc, tm)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go recordTraffic(ctx, tm)
+	go recordQuotas(ctx, tm)
+	<-ctx.Done()
+	log.Println("Shutting down all tunnels...")
+	tm.StopAll()
+	saveTraffic(tm)
+	saveQuotas(tm)
 }
 
 func stopAndCleanTunnel(reader *bufio.Reader) {
@@ -1037,7 +8236,8 @@ func stopAndCleanTunnel(reader *bufio.Reader) {
 		fmt.Println("Operation cancelled.")
 		return
 	}
-	if pidBytes, err := os.ReadFile(pidFilePath); err == nil {
+	pidFile, readyFile := tunnelFiles(menuTunnel)
+	if pidBytes, err := os.ReadFile(pidFile); err == nil {
 		pid, _ := strconv.Atoi(string(pidBytes))
 		if process, err := os.FindProcess(pid); err == nil {
 			fmt.Printf("Stopping tunnel process (PID: %d)...\n", pid)
@@ -1052,8 +8252,8 @@ func stopAndCleanTunnel(reader *bufio.Reader) {
 	deleteFile("server.crt")
 	deleteFile("server.key")
 	deleteFile(logFilePath)
-	deleteFile(pidFilePath)
-	deleteFile(successSignalPath)
+	deleteFile(pidFile)
+	deleteFile(readyFile)
 	fmt.Println("✅ Cleanup complete.")
 }
 func uninstallSelf(reader *bufio.Reader) {
@@ -1072,9 +8272,10 @@ func uninstallSelf(reader *bufio.Reader) {
 		fmt.Println("Error: Could not determine executable path:", err)
 		return
 	}
-	deleteFile(pidFilePath)
+	pidFile, readyFile := tunnelFiles(menuTunnel)
+	deleteFile(pidFile)
 	deleteFile(logFilePath)
-	deleteFile(successSignalPath)
+	deleteFile(readyFile)
 	fmt.Printf("Removing executable: %s\n", executablePath)
 	if err = os.Remove(executablePath); err != nil {
 		fmt.Printf("Error: Failed to remove executable: %v\n", err)
@@ -1084,7 +8285,8 @@ func uninstallSelf(reader *bufio.Reader) {
 	os.Exit(0)
 }
 func isTunnelRunning() bool {
-	pidBytes, err := os.ReadFile(pidFilePath)
+	pidFile, _ := tunnelFiles(menuTunnel)
+	pidBytes, err := os.ReadFile(pidFile)
 	if err != nil {
 		return false
 	}
@@ -1117,8 +8319,8 @@ func monitorLogs() {
 	_ = cmd.Run()
 	fmt.Println("\n... Stopped monitoring.")
 }
-func configureLogging() {
-	logFile, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+func configureLogging(path string) {
+	logFile, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
 	if err != nil {
 		log.Fatalf("Failed to open log file: %v", err)
 	}
@@ -1169,6 +8371,130 @@ func generateSelfSignedCert() error {
 	pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
 	return nil
 }
+
+// caCreate writes a new self-signed CA used to issue per-client and server
+// certificates for TLS transports.
+func caCreate(dir string) error {
+	certPath, keyPath := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	if _, err := os.Stat(keyPath); err == nil {
+		return fmt.Errorf("%s already exists", keyPath)
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{Organization: []string{"Phantom Tunnel"}, CommonName: "Phantom Tunnel CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * 24 * 3650),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		return err
+	}
+	if err := writeCertAndKey(certPath, keyPath, derBytes, priv); err != nil {
+		return err
+	}
+	fmt.Printf("✅ CA created: %s, %s\n", certPath, keyPath)
+	return nil
+}
+
+// caIssue signs a certificate with the CA in dir. With no hosts it is a
+// client certificate named name; otherwise a server certificate for hosts.
+// It will not replace name.crt or name.key unless force is set.
+func caIssue(dir, name string, hosts []string, force bool) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid certificate name %q", name)
+	}
+	if name == "ca" {
+		return errors.New(`"ca" is the CA's own certificate; pick another name`)
+	}
+	certPath, keyPath := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if !force {
+		for _, path := range []string{certPath, keyPath} {
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("%s already exists (use --ca-force to replace it)", path)
+			}
+		}
+	}
+	caCert, caKey, err := loadCA(dir)
+	if err != nil {
+		return err
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{Organization: []string{"Phantom Tunnel"}, CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour * 24 * 825),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if len(hosts) > 0 {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.Subject.CommonName = hosts[0]
+		for _, h := range hosts {
+			if ip := net.ParseIP(h); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else if h != "" {
+				template.DNSNames = append(template.DNSNames, h)
+			}
+		}
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, caCert, &priv.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	if err := writeCertAndKey(certPath, keyPath, derBytes, priv); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(derBytes)
+	fmt.Printf("✅ Issued %s, %s\n🔐 SHA-256 fingerprint: %s\n", certPath, keyPath, formatFingerprint(sum[:]))
+	return nil
+}
+
+func loadCA(dir string) (*x509.Certificate, crypto.Signer, error) {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading CA (run --ca-init first?): %w", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("CA key cannot sign")
+	}
+	return cert, signer, nil
+}
+
+func writeCertAndKey(certPath, keyPath string, derBytes []byte, priv *ecdsa.PrivateKey) error {
+	keyBytes, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes}), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600)
+}
+
+func randomSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+	return serial
+}
+
 func generateRandomPath() string {
 	bytes := make([]byte, 8)
 	if _, err := rand.Read(bytes); err != nil {
@@ -0,0 +1,605 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 to dir.
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	if err := writeCertAndKey(certFile, keyFile, der, priv); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// freeUDPAddr returns a loopback UDP address nothing is listening on.
+func freeUDPAddr(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	return pc.LocalAddr().String()
+}
+
+// startQUICServer runs listenQUIC for a server tunnel on loopback until the
+// test ends. It returns the tunnel's config and the pool sessions land in.
+func startQUICServer(t *testing.T, token string) (*Config, *sessionPool) {
+	t.Helper()
+	cfg := &Config{Name: "test", Mode: "server", Transport: "quic", Token: token, Listen: freeUDPAddr(t)}
+	cfg.CertFile, cfg.KeyFile = writeTestCert(t, t.TempDir())
+	cfg.applyDefaults()
+	tun := newTunnel(cfg, nil)
+	pool := newSessionPool(cfg.Balance)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- tun.listenQUIC(ctx, pool, newAuthenticator(token)) }()
+	t.Cleanup(func() {
+		cancel()
+		pool.CloseAll()
+		if err := <-done; err != nil {
+			t.Errorf("listenQUIC: %v", err)
+		}
+	})
+	return cfg, pool
+}
+
+// dialTestServer dials the server started by startQUICServer with its
+// certificate pinned.
+func dialTestServer(t *testing.T, server *Config, token string) (muxSession, error) {
+	t.Helper()
+	pin, err := certFingerprint(server.CertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{Mode: "client", Transport: "quic", Server: server.Listen, PinSHA256: pin}
+	tlsConfig, err := clientTLSConfig(cfg, ServerEndpoint{Address: cfg.Server, Transport: cfg.Transport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// The listener may still be starting.
+	for {
+		session, err := dialQUIC(ctx, cfg.Server, tlsConfig, token)
+		if err == nil || ctx.Err() != nil || strings.Contains(err.Error(), "auth") {
+			return session, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestQUICTransfer(t *testing.T) {
+	server, pool := startQUICServer(t, "secret")
+	session, err := dialTestServer(t, server, "secret")
+	if err != nil {
+		t.Fatalf("dialQUIC: %v", err)
+	}
+	defer session.Close()
+	version, _, control := sendHello(session, nil, nil)
+	if control == nil || version != maxStreamVersion {
+		t.Fatalf("hello: got version %d, control %v", version, control)
+	}
+	defer control.Close()
+
+	var cs *clientSession
+	for deadline := time.Now().Add(5 * time.Second); cs == nil; {
+		if cs = pool.Get("", "tcp"); cs == nil {
+			if time.Now().After(deadline) {
+				t.Fatal("session never joined the pool")
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	// The client echoes whatever the server sends on the first stream it
+	// opens, the way a local target would.
+	go func() {
+		s, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		io.Copy(s, s)
+	}()
+
+	stream, err := cs.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(30 * time.Second))
+
+	sent := make([]byte, 8<<20)
+	rand.Read(sent)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(sent)
+		errc <- err
+	}()
+	got := make([]byte, len(sent))
+	if _, err := io.ReadFull(stream, got); err != nil {
+		t.Fatalf("reading echo: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+	if !bytes.Equal(got, sent) {
+		t.Fatal("echoed data differs from what was sent")
+	}
+}
+
+func TestQUICWrongToken(t *testing.T) {
+	server, pool := startQUICServer(t, "secret")
+	session, err := dialTestServer(t, server, "not-the-secret")
+	if err == nil {
+		session.Close()
+		t.Fatal("dialQUIC succeeded with the wrong token")
+	}
+	if !strings.Contains(err.Error(), "rejected") {
+		t.Fatalf("dialQUIC: got %v, want an auth rejection", err)
+	}
+	if n := pool.Len(); n != 0 {
+		t.Fatalf("pool has %d sessions after a failed auth", n)
+	}
+}
+
+func TestStreamHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		version int
+		header  streamHeader
+	}{
+		{streamVersion1, streamHeader{Target: 0}},
+		{streamVersion1, streamHeader{Target: 255}},
+		{streamVersion2, streamHeader{Target: 0}},
+		{streamVersion2, streamHeader{Target: 0xFFFF, Source: "203.0.113.7:51234"}},
+		{streamVersion2, streamHeader{Target: 3, Source: "[2001:db8::1]:443", Meta: map[string]string{
+			"service": "web", "network": "udp", "dial": "db.internal:5432", "empty": "",
+		}}},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := writeStreamHeader(&buf, tt.version, &tt.header); err != nil {
+			t.Fatalf("v%d %+v: write: %v", tt.version, tt.header, err)
+		}
+		buf.WriteString("payload")
+		got, err := readStreamHeader(&buf, tt.version)
+		if err != nil {
+			t.Fatalf("v%d %+v: read: %v", tt.version, tt.header, err)
+		}
+		if !reflect.DeepEqual(*got, tt.header) {
+			t.Errorf("v%d: got %+v, want %+v", tt.version, *got, tt.header)
+		}
+		if rest := buf.String(); rest != "payload" {
+			t.Errorf("v%d: header read left %q, want the payload untouched", tt.version, rest)
+		}
+	}
+}
+
+func TestStreamHeaderLimits(t *testing.T) {
+	bad := []struct {
+		version int
+		header  streamHeader
+	}{
+		{streamVersion1, streamHeader{Target: 256}},
+		{streamVersion1, streamHeader{Target: -1}},
+		{streamVersion2, streamHeader{Target: 0x10000}},
+		{streamVersion2, streamHeader{Source: strings.Repeat("a", 256)}},
+		{streamVersion2, streamHeader{Meta: map[string]string{strings.Repeat("k", 256): "v"}}},
+		{streamVersion2, streamHeader{Meta: map[string]string{"k": strings.Repeat("v", maxHeaderSize)}}},
+	}
+	for _, tt := range bad {
+		if _, err := tt.header.marshal(tt.version); err == nil {
+			t.Errorf("v%d: marshal accepted %+v", tt.version, tt.header)
+		}
+	}
+	if _, err := readStreamHeader(bytes.NewReader([]byte{streamVersion1, 0, 0}), streamVersion2); err == nil {
+		t.Error("a version 1 header was accepted on a version 2 stream")
+	}
+	if _, err := readStreamHeader(bytes.NewReader([]byte{streamVersion2, 0xFF, 0xFF}), streamVersion2); err == nil {
+		t.Error("an oversized header length was accepted")
+	}
+}
+
+func FuzzReadStreamHeader(f *testing.F) {
+	for _, h := range []streamHeader{
+		{Target: 1},
+		{Target: 2, Source: "198.51.100.1:1234", Meta: map[string]string{"service": "web", "network": "tcp"}},
+	} {
+		data, _ := h.marshal(streamVersion2)
+		f.Add(data, true)
+		f.Add(data[:len(data)-1], true)
+	}
+	f.Add([]byte{7}, false)
+	f.Add([]byte{streamVersion2, 0, 5, 0, 0, 0, 1, 1}, true)
+	f.Fuzz(func(t *testing.T, data []byte, v2 bool) {
+		version := streamVersion1
+		if v2 {
+			version = streamVersion2
+		}
+		h, err := readStreamHeader(bytes.NewReader(data), version)
+		if err != nil {
+			return
+		}
+		// Whatever was accepted must survive being written again.
+		out, err := h.marshal(version)
+		if err != nil {
+			t.Fatalf("re-marshal of %+v: %v", h, err)
+		}
+		again, err := readStreamHeader(bytes.NewReader(out), version)
+		if err != nil {
+			t.Fatalf("re-read of %x: %v", out, err)
+		}
+		if !reflect.DeepEqual(again, h) {
+			t.Fatalf("round trip changed %+v into %+v", h, again)
+		}
+	})
+}
+
+func TestControlRoundTrip(t *testing.T) {
+	msgs := []*controlMessage{
+		{Type: "hello", StreamVersion: maxStreamVersion, Services: []string{"api", "web"}, Features: []string{"forward"}},
+		{Type: "open_port", Service: "web", Port: "20000-20100"},
+		{Type: "dial_result", Error: "destination is not allowed", Refused: true},
+	}
+	var buf bytes.Buffer
+	for _, msg := range msgs {
+		if err := writeControl(&buf, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range msgs {
+		got, err := readControl(&buf)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+	if _, err := readControl(&buf); err != io.EOF {
+		t.Errorf("read past the last message: got %v, want EOF", err)
+	}
+}
+
+func FuzzReadControl(f *testing.F) {
+	var buf bytes.Buffer
+	writeControl(&buf, &controlMessage{Type: "hello", StreamVersion: 2, Services: []string{"web"}})
+	f.Add(buf.Bytes())
+	f.Add([]byte{0, 0, 0, 2, '{', '}'})
+	f.Add([]byte{0xFF, 0xFF, 0xFF, 0xFF})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := readControl(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		var out bytes.Buffer
+		if err := writeControl(&out, msg); err != nil {
+			t.Fatalf("re-write of %+v: %v", msg, err)
+		}
+		if out.Len()-4 > maxControlSize {
+			// Escaping can make the JSON longer than what was read.
+			return
+		}
+		again, err := readControl(&out)
+		if err != nil {
+			t.Fatalf("re-read: %v", err)
+		}
+		a, _ := json.Marshal(msg)
+		b, _ := json.Marshal(again)
+		if !bytes.Equal(a, b) {
+			t.Fatalf("round trip changed %s into %s", a, b)
+		}
+	})
+}
+
+func TestSessionOffers(t *testing.T) {
+	named := &clientSession{services: []string{"web"}}
+	unnamed := &clientSession{}
+	tests := []struct {
+		cs      *clientSession
+		service string
+		want    bool
+	}{
+		{named, "", true},
+		{named, "web", true},
+		{named, "api", false},
+		{unnamed, "", true},
+		{unnamed, "web", false},
+	}
+	for _, tt := range tests {
+		if got := tt.cs.offers(tt.service); got != tt.want {
+			t.Errorf("session offering %v: offers(%q) = %v, want %v", tt.cs.services, tt.service, got, tt.want)
+		}
+	}
+}
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		src, dst         string
+		wantSrc, wantDst string
+	}{
+		{"203.0.113.7:51234", "192.0.2.1:443", "203.0.113.7:51234", "192.0.2.1:443"},
+		{"[2001:db8::7]:51234", "[2001:db8::1]:443", "[2001:db8::7]:51234", "[2001:db8::1]:443"},
+		// Mixed families travel as IPv6 and come back unmapped.
+		{"203.0.113.7:51234", "[2001:db8::1]:443", "203.0.113.7:51234", "[2001:db8::1]:443"},
+		{"[::ffff:203.0.113.7]:1", "192.0.2.1:2", "203.0.113.7:1", "192.0.2.1:2"},
+		// Anything else is sent as UNKNOWN.
+		{"pipe", "192.0.2.1:443", "", ""},
+	}
+	for _, version := range []int{1, 2} {
+		for _, tt := range tests {
+			data := append(proxyHeader(version, tt.src, tt.dst), "payload"...)
+			r := bufio.NewReader(bytes.NewReader(data))
+			src, dst, err := readProxyHeader(r)
+			if err != nil {
+				t.Fatalf("v%d %s -> %s: %v", version, tt.src, tt.dst, err)
+			}
+			if src != tt.wantSrc || dst != tt.wantDst {
+				t.Errorf("v%d %s -> %s: got %q -> %q, want %q -> %q", version, tt.src, tt.dst, src, dst, tt.wantSrc, tt.wantDst)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+				t.Errorf("v%d: header read left %q, want the payload untouched", version, rest)
+			}
+		}
+	}
+}
+
+func TestReadProxyHeaderRejects(t *testing.T) {
+	for _, data := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1 70000\r\n",
+		"PROXY TCP6 fe80::1%eth0 ::1 1 2\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1 2\n",
+		"PROXY " + strings.Repeat("A", maxProxyV1Line) + "\r\n",
+		string(proxyV2Signature) + "\x11\x11\x00\x0c",
+		string(proxyV2Signature) + "\x21\x11\x00\x04abcd",
+		string(proxyV2Signature) + "\x21\x11\xff\xff",
+	} {
+		if src, dst, err := readProxyHeader(bufio.NewReader(strings.NewReader(data))); err == nil {
+			t.Errorf("%q: accepted as %q -> %q", data, src, dst)
+		}
+	}
+}
+
+func FuzzReadProxyHeader(f *testing.F) {
+	f.Add(proxyHeader(1, "203.0.113.7:51234", "192.0.2.1:443"))
+	f.Add(proxyHeader(1, "[2001:db8::7]:1", "[2001:db8::1]:2"))
+	f.Add(proxyHeader(2, "203.0.113.7:51234", "192.0.2.1:443"))
+	f.Add(proxyHeader(2, "[2001:db8::7]:1", "[2001:db8::1]:2"))
+	f.Add(proxyHeader(2, "", ""))
+	f.Add([]byte("PROXY UNKNOWN\r\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		src, dst, err := readProxyHeader(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil || src == "" {
+			return
+		}
+		// Addresses that were accepted must be passed on unchanged.
+		for _, version := range []int{1, 2} {
+			gotSrc, gotDst, err := readProxyHeader(bufio.NewReader(bytes.NewReader(proxyHeader(version, src, dst))))
+			if err != nil {
+				t.Fatalf("v%d of %s -> %s: %v", version, src, dst, err)
+			}
+			if gotSrc != src || gotDst != dst {
+				t.Fatalf("v%d changed %s -> %s into %s -> %s", version, src, dst, gotSrc, gotDst)
+			}
+		}
+	})
+}
+
+func TestConnectionLimitBytes(t *testing.T) {
+	tests := []struct {
+		cfg  Config
+		want int
+	}{
+		{Config{RateLimitBytes: 512}, 512},
+		{Config{RateLimitBytes: 1500}, 1500},
+		{Config{RateLimitKB: 2, RateLimitBytes: 512}, 2048},
+		{Config{}, 0},
+	}
+	for _, tt := range tests {
+		in, out := tt.cfg.connectionLimit().rates()
+		if in != tt.want || out != tt.want {
+			t.Errorf("rate_limit_kb %d, --ratelimit %d: got %d/%d B/s, want %d", tt.cfg.RateLimitKB, tt.cfg.RateLimitBytes, in, out, tt.want)
+		}
+	}
+}
+
+// udpPeerRefusals sends 50 datagrams from one peer to a UDP listener of a
+// server tunnel with no clients and returns the peer's count in the
+// endpoint stats picked by count, once it has been counted at all.
+func udpPeerRefusals(t *testing.T, cfg *Config, count func(*EndpointStats) int64) int64 {
+	t.Helper()
+	cfg.applyDefaults()
+	tun := newTunnel(cfg, nil)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicAddr := pc.LocalAddr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tun.startUDPListener(ctx, pc, publicAddr, 0, "", newSessionPool(cfg.Balance))
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	conn, err := net.Dial("udp", publicAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	counted := func() int64 {
+		tun.stats.Lock()
+		defer tun.stats.Unlock()
+		if ep := tun.stats.Endpoints[publicAddr]; ep != nil {
+			return count(ep)
+		}
+		return 0
+	}
+	for i := 0; i < 50; i++ {
+		conn.Write([]byte("ping"))
+	}
+	for deadline := time.Now().Add(5 * time.Second); counted() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the peer was never refused")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Let the listener drain the rest of the datagrams.
+	time.Sleep(200 * time.Millisecond)
+	return counted()
+}
+
+func TestUDPRejectedPeerCountedOnce(t *testing.T) {
+	cfg := &Config{Name: "test", Mode: "server", Transport: "tcpmux", Token: "secret",
+		Access: []AccessConfig{{Deny: []string{"127.0.0.0/8"}}}}
+	if n := udpPeerRefusals(t, cfg, func(ep *EndpointStats) int64 { return ep.Rejected }); n != 1 {
+		t.Fatalf("denied peer rejected %d times within the window, want once", n)
+	}
+}
+
+func TestUDPUnservedPeerCountedOnce(t *testing.T) {
+	cfg := &Config{Name: "test", Mode: "server", Transport: "tcpmux", Token: "secret"}
+	if n := udpPeerRefusals(t, cfg, func(ep *EndpointStats) int64 { return ep.Errors }); n != 1 {
+		t.Fatalf("peer without a client counted %d times within the window, want once", n)
+	}
+}
+
+func TestBanClientAddr(t *testing.T) {
+	var bl banList
+	bl.configure(AuthBansConfig{TrustedProxies: []string{"10.0.0.0/8"}, ClientIPHeader: "X-Forwarded-For"})
+	tests := []struct {
+		remote, header, want string
+	}{
+		{"203.0.113.5:4000", "198.51.100.1", "203.0.113.5:4000"},
+		{"10.0.0.1:4000", "198.51.100.1", "198.51.100.1:0"},
+		{"10.0.0.1:4000", "192.0.2.9, 198.51.100.1, 10.0.0.2", "198.51.100.1:0"},
+		{"10.0.0.1:4000", "[2001:db8::1]:555", "[2001:db8::1]:0"},
+		{"10.0.0.1:4000", "10.0.0.3", ""},
+		{"10.0.0.1:4000", "", ""},
+		{"10.0.0.1:4000", "unknown", ""},
+	}
+	for _, tt := range tests {
+		r, _ := http.NewRequest("GET", "/connect", nil)
+		r.RemoteAddr = tt.remote
+		if tt.header != "" {
+			r.Header.Set("X-Forwarded-For", tt.header)
+		}
+		if got := bl.clientAddr(r); got != tt.want {
+			t.Errorf("%s with %q: got %q, want %q", tt.remote, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTokenOptionalWithClientCA(t *testing.T) {
+	cfg := &Config{Name: "test", Mode: "server", Transport: "tcpmux+tls", Listen: ":4443", PublicPorts: []string{"8000"}}
+	cfg.CertFile, cfg.KeyFile = writeTestCert(t, t.TempDir())
+	cfg.ClientCA = cfg.CertFile
+	cfg.applyDefaults()
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("client_ca without a token: %v", err)
+	}
+	cfg.ClientCA = ""
+	if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), "token: required") {
+		t.Fatalf("no token and no client_ca: got %v, want token: required", err)
+	}
+}
+
+func TestDashboardLoginLockoutConcurrent(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("right"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newDashboardAuth(DashboardConfig{Users: []DashboardUser{{Username: "admin", PasswordHash: string(hash)}}})
+	if ok, _ := a.checkPassword("192.0.2.1:1000", "admin", "right"); !ok {
+		t.Fatal("correct password refused")
+	}
+
+	var wg sync.WaitGroup
+	var tried atomic.Int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, locked := a.checkPassword("192.0.2.1:1000", "admin", "wrong"); ok {
+				t.Error("wrong password accepted")
+			} else if !locked {
+				tried.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	// The fifth failure locks the IP, so only four may come back unlocked.
+	if n := tried.Load(); n > maxLoginFailures-1 {
+		t.Errorf("%d parallel bad logins got through before the lockout, want at most %d", n, maxLoginFailures-1)
+	}
+	if ok, locked := a.checkPassword("192.0.2.1:1000", "admin", "right"); ok || !locked {
+		t.Errorf("after the lockout: ok %v, locked %v; want refused and locked", ok, locked)
+	}
+	if ok, _ := a.checkPassword("192.0.2.2:1000", "admin", "right"); !ok {
+		t.Error("another IP was locked out too")
+	}
+}
+
+func TestReconfigurePortsAllOrNothing(t *testing.T) {
+	cfg := &Config{Name: "test", Mode: "server", Transport: "tcpmux", Token: "secret", PublicPorts: []string{"8000", "8001"}}
+	cfg.applyDefaults()
+	tun := newTunnel(cfg, nil)
+
+	// 8000 is closed first; 8001 then cannot be opened a second time.
+	next := tun.Config()
+	next.PublicPorts = []string{"", "8001", "8001"}
+	if err := tun.Reconfigure(next); err == nil {
+		t.Fatal("opening 8001 twice succeeded")
+	}
+	if got := tun.Config().PublicPorts; !reflect.DeepEqual(got, []string{"8000", "8001"}) {
+		t.Fatalf("after the failed change: public ports %q, want the old ones", got)
+	}
+}
@@ -89,7 +89,7 @@ for file in "${LEGACY_FILES[@]}"; do
 done
 
 print_info "Cleaning up temporary files..."
-rm -f /tmp/phantom.pid
+rm -f /tmp/phantom.pid /tmp/phantom-*.pid /tmp/phantom-*.ready
 rm -f /tmp/phantom-panel.log
 rm -f /tmp/phantom-tunnel.log
 